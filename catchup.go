@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// The catch-up policies say what to do with a reminder that is going out late, usually because the scheduler was
+// down when it was due. catchUpSend sends it as long as sweeping hasn't started yet and skips it otherwise,
+// catchUpSkip never sends late reminders, and catchUpApologize is like catchUpSend but texts a "sorry, we missed
+// it" notice instead of skipping, once for each schedule and only for the last sweeping day it missed. Skipped and
+// late reminders are all recorded for the late-report command.
+const (
+	catchUpSend      = "send"
+	catchUpSkip      = "skip"
+	catchUpApologize = "apologize"
+)
+
+// The outcomes recorded for a late reminder.
+const (
+	outcomeSentLate   = "sent_late"
+	outcomeSkipped    = "skipped"
+	outcomeApologized = "apologized"
+)
+
+// lateAfter is how long after it was due a reminder counts as late. FindReadyAlerts runs every 10 seconds, so
+// anything much later than that means the scheduler wasn't running.
+const lateAfter = 15 * time.Minute
+
+// catchUpPolicy is set from STREETSWEEP_CATCHUP_POLICY when the server starts.
+var catchUpPolicy = catchUpSend
+
+func validCatchUpPolicy(policy string) bool {
+	return policy == catchUpSend || policy == catchUpSkip || policy == catchUpApologize
+}
+
+// catchUp decides what to do about a reminder for sweepDay that should have gone out at due. It returns the
+// message to send, which is "" if nothing should be sent, and if the reminder is late, the outcome to record.
+func catchUp(policy string, d Day, message string, sweepDay, due, now time.Time) (string, string) {
+	if now.Sub(due) <= lateAfter {
+		return message, ""
+	}
+	if now.Before(sweepStart(d, sweepDay)) {
+		if policy == catchUpSkip {
+			return "", outcomeSkipped
+		}
+		return message, outcomeSentLate
+	}
+	if policy == catchUpApologize {
+		return missedMessage(sweepDay), outcomeApologized
+	}
+	return "", outcomeSkipped
+}
+
+// sweepStart is when sweeping starts on sweepDay: the start of the schedule's time window if it has one, and
+// midnight if it doesn't.
+func sweepStart(d Day, sweepDay time.Time) time.Time {
+	minutes, err := parseClock(d.Start)
+	if err != nil {
+		return sweepDay
+	}
+	return time.Date(sweepDay.Year(), sweepDay.Month(), sweepDay.Day(), minutes/60, minutes%60, 0, 0, sweepDay.Location())
+}
+
+// missedAgain reports whether the sweeping day after the one a reminder missed, which nextCall is for, has started
+// by now as well. Only the most recent sweeping day someone missed gets an apology; the ones before it are skipped.
+func missedAgain(d Day, r Reminder, nextCall int64, location *time.Location, now time.Time) bool {
+	if nextCall == math.MaxInt64 {
+		return false
+	}
+	next := r.sweepDay(time.Unix(nextCall, 0).In(location))
+	return !now.Before(sweepStart(d, next))
+}
+
+func missedMessage(sweepDay time.Time) string {
+	return "Sorry! We missed your reminder about street sweeping on " + sweepDay.Format("Monday, Jan 2") +
+		". Please check that your car wasn't ticketed. (to stop getting these reminders, go to dontfearthesweeper.com/remove or email ouidevelop@gmail.com)"
+}
+
+// lateReportCommand lists every reminder that went out late or was skipped because it was due while the scheduler
+// was down, for reminders due between -since and -until.
+func lateReportCommand(env *Env, args []string) error {
+	return env.lateReport(os.Stdout, args)
+}
+
+// lateReport writes the late-report command's report to out.
+func (env *Env) lateReport(out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("late-report", flag.ContinueOnError)
+	since := flags.String("since", "", "only reminders due at or after this time, like 2017-09-04T19:00:00Z (required)")
+	until := flags.String("until", "", "only reminders due before this time (defaults to now)")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *since == "" {
+		return fmt.Errorf("-since is required")
+	}
+	sinceTime, err := time.Parse(time.RFC3339, *since)
+	if err != nil {
+		return fmt.Errorf("-since: %v", err)
+	}
+	untilTime := Now()
+	if *until != "" {
+		untilTime, err = time.Parse(time.RFC3339, *until)
+		if err != nil {
+			return fmt.Errorf("-until: %v", err)
+		}
+	}
+
+	late, err := env.Store.LateReminders(sinceTime, untilTime)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SCHEDULE\tREMINDER\tPHONE\tDUE\tHANDLED\tOUTCOME")
+	for _, l := range late {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\n", l.ScheduleID, l.ReminderID, l.PhoneNumber,
+			time.Unix(l.DueAt, 0).UTC().Format(time.RFC3339), time.Unix(l.HandledAt, 0).UTC().Format(time.RFC3339), l.Outcome)
+	}
+	fmt.Fprintf(w, "%d late or skipped reminders\n", len(late))
+	return w.Flush()
+}
+
+// lateReminder is a reminder that was handled late, and what was done about it.
+type lateReminder struct {
+	ReminderID  int
+	ScheduleID  int
+	PhoneNumber string
+	DueAt       int64
+	HandledAt   int64
+	Outcome     string
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// commands are maintenance jobs that run instead of the server when the app is started with a command name, like
+// `dontfearthesweeper late-report -since 2017-09-04T00:00:00Z`. Each one gets the rest of the arguments to parse
+// as its own flags, and the env to get at the store.
+var commands = map[string]func(env *Env, args []string) error{
+	"export":            exportCommand,
+	"import":            importCommand,
+	"late-report":       lateReportCommand,
+	"migrate":           migrateCommand,
+	"purge-removed":     purgeRemovedCommand,
+	"recompute":         recomputeCommand,
+	"rotate-phone-keys": rotatePhoneKeysCommand,
+}
+
+func runCommand(env *Env, name string, args []string) error {
+	command, ok := commands[name]
+	if !ok {
+		var names []string
+		for n := range commands {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q, the commands are: %s", name, strings.Join(names, ", "))
+	}
+	return command(env, args)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The kinds of consent event: someone agreeing to get our texts, or saying they don't want them any more.
+const (
+	consentOptIn  = "opt_in"
+	consentOptOut = "opt_out"
+)
+
+// The places consent can be given or taken back: on the website, by texting us, or by asking an admin to remove
+// their alerts.
+const (
+	consentFromWeb   = "web"
+	consentFromSMS   = "sms"
+	consentFromAdmin = "admin"
+)
+
+// disclosureVersion is the version of what the signup page tells people about the texts they will get. Change it
+// whenever that text changes, so the consent ledger says what each person agreed to.
+const disclosureVersion = "2017-10-01"
+
+// consentEvent is an entry in the consent ledger, the record carriers and the TCPA want of when and how someone
+// agreed to get our texts, or stopped. IPHash and UserAgentHash are hashes of where the request came from, so we
+// can show it was them without keeping their IP address; they are empty for texts.
+type consentEvent struct {
+	ID                int    `json:"id,omitempty"`
+	PhoneNumber       string `json:"phoneNumber"`
+	Kind              string `json:"kind"`
+	Source            string `json:"source"`
+	DisclosureVersion string `json:"disclosureVersion"`
+	IPHash            string `json:"ipHash"`
+	UserAgentHash     string `json:"userAgentHash"`
+	RequestID         string `json:"requestId"`
+	At                int64  `json:"at"`
+}
+
+// validate checks that c is an event the consent ledger can have, for events that didn't just happen here, like the
+// ones in a snapshot.
+func (c consentEvent) validate() error {
+	if c.PhoneNumber == "" {
+		return fmt.Errorf("no phone number")
+	}
+	if c.Kind != consentOptIn && c.Kind != consentOptOut {
+		return fmt.Errorf("kind must be %q or %q, got %q", consentOptIn, consentOptOut, c.Kind)
+	}
+	if c.Source != consentFromWeb && c.Source != consentFromSMS && c.Source != consentFromAdmin {
+		return fmt.Errorf("unknown source %q", c.Source)
+	}
+	if c.At <= 0 {
+		return fmt.Errorf("no time it happened at")
+	}
+	return nil
+}
+
+// webConsent is a consent event of kind for phoneNumber, made now on the website by the request r.
+func webConsent(r *http.Request, phoneNumber, kind string) consentEvent {
+	return consentEvent{
+		PhoneNumber:       phoneNumber,
+		Kind:              kind,
+		Source:            consentFromWeb,
+		DisclosureVersion: disclosureVersion,
+		IPHash:            consentHash(clientIP(r)),
+		UserAgentHash:     consentHash(r.UserAgent()),
+		RequestID:         requestID(r),
+		At:                Now().Unix(),
+	}
+}
+
+// smsConsent is a consent event of kind for phoneNumber, made now by the text with ID messageID.
+func smsConsent(phoneNumber, kind, messageID string) consentEvent {
+	return consentEvent{
+		PhoneNumber:       phoneNumber,
+		Kind:              kind,
+		Source:            consentFromSMS,
+		DisclosureVersion: disclosureVersion,
+		RequestID:         messageID,
+		At:                Now().Unix(),
+	}
+}
+
+// clientIP returns the IP address r came from. Heroku's router puts it last in X-Forwarded-For.
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		ips := strings.Split(forwarded, ",")
+		return strings.TrimSpace(ips[len(ips)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// consentHash hashes value with the phone number index key, so that hashes of IP addresses, of which there aren't
+// many, can't be reversed by hashing them all. Without keys, like in the tests, it is a plain SHA-256.
+func consentHash(value string) string {
+	if value == "" {
+		return ""
+	}
+	if phoneKeys != nil {
+		return phoneKeys.index(value)
+	}
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// errOptedOut is the error for doing something that would text someone whose last word in the consent ledger is that
+// they don't want our texts.
+var errOptedOut = errors.New("they opted out, so only they can sign up again")
+
+// optedOut reports whether the latest event in phoneNumber's consent ledger is an opt out. The latest is the one
+// that happened last, not the one recorded last, since importing a snapshot can add older events after newer ones;
+// the ID only breaks ties.
+func (env *Env) optedOut(phoneNumber string) (bool, error) {
+	if phoneNumber == "" {
+		return false, nil
+	}
+	consents, err := env.Store.Consents(phoneNumber)
+	if err != nil || len(consents) == 0 {
+		return false, err
+	}
+	latest := consents[0]
+	for _, c := range consents[1:] {
+		if c.At > latest.At || (c.At == latest.At && c.ID > latest.ID) {
+			latest = c
+		}
+	}
+	return latest.Kind == consentOptOut, nil
+}
+
+// recordOptOut adds an opt out to the consent ledger. They have opted out whether or not it can be recorded, so a
+// problem recording it is only logged.
+func (env *Env) recordOptOut(c consentEvent) {
+	err := env.Store.RecordConsent(c)
+	if err != nil {
+		log.Println("problem recording opt out: ", err)
+	}
+}
+
+// adminConsentsHandler lists the consent ledger for the phoneNumber query parameter, oldest first.
+func (env *Env) adminConsentsHandler(w http.ResponseWriter, r *http.Request) {
+	if !env.isAdmin(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, "not authorized")
+		return
+	}
+
+	phoneNumber := r.URL.Query().Get("phoneNumber")
+	if phoneNumber == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "phoneNumber is required")
+		return
+	}
+	consents, err := env.Store.Consents(phoneNumber)
+	if err != nil {
+		log.Println("problem finding consents: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "oops! we made a mistake")
+		return
+	}
+	if consents == nil {
+		consents = []consentEvent{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string][]consentEvent{"consents": consents})
+}
@@ -1,136 +1,826 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
 	"fmt"
-	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// FindReadyAlerts finds all alerts that are ready to be sent (that is, that has a "next call" that is before now),
-// and sends a text message reminder to those alerts.
-func FindReadyAlerts(sender smsMessager) {
-	findReadyAlertStmt, err := DB.Prepare("select ID, PHONE_NUMBER, NTH_DAY, TIMEZONE, WEEKDAY from alerts where NEXT_CALL < ?")
+// The SQL databases sqlStore can use. Queries are written for MySQL, with ? placeholders, and rebind changes them
+// for postgres.
+type dialect string
+
+const (
+	mysqlDialect    dialect = "mysql"
+	postgresDialect dialect = "postgres"
+)
+
+// rebind changes the ? placeholders in query to the dialect's own.
+func (d dialect) rebind(query string) string {
+	if d != postgresDialect {
+		return query
+	}
+	var b bytes.Buffer
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// sqlStore is the AlertStore the app uses in production, on MySQL or postgres.
+type sqlStore struct {
+	// db is a database handle representing a pool of zero or more
+	// underlying connections. It's safe for concurrent use by multiple
+	// goroutines.
+	// **(from sql package)**
+	db      *sql.DB
+	dialect dialect
+}
+
+// openSQLStore connects to the database at dsn. Postgres DSNs start with postgres:// or postgresql://, and
+// anything else is a MySQL DSN, with or without a mysql:// in front. It doesn't apply any migrations.
+func openSQLStore(dsn string) (*sqlStore, error) {
+	d := mysqlDialect
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		d = postgresDialect
+	case strings.HasPrefix(dsn, "mysql://"):
+		dsn = strings.TrimPrefix(dsn, "mysql://")
+	}
+
+	db, err := sql.Open(string(d), dsn)
 	if err != nil {
-		log.Println("In FindReadyAlerts, problem preparing database statement: ", err)
+		return nil, err
 	}
-	defer findReadyAlertStmt.Close()
 
-	updateStmt, err := DB.Prepare("UPDATE alerts SET NEXT_CALL = ? WHERE ID = ?")
+	err = db.Ping()
 	if err != nil {
-		log.Println("In FindReadyAlerts, problem preparing database update statement: ", err)
+		return nil, err
 	}
-	defer updateStmt.Close()
 
-	nowUTC := Now().Unix()
-	rows, err := findReadyAlertStmt.Query(nowUTC)
+	return &sqlStore{db: db, dialect: d}, nil
+}
+
+// upsert runs an INSERT that can clash with an existing row on the unique columns in conflict. It returns the ID of
+// the new row, or of the existing one, and whether it inserted a row.
+func (s *sqlStore) upsert(tx *sql.Tx, query, conflict string, args ...interface{}) (id int64, inserted bool, err error) {
+	if s.dialect == postgresDialect {
+		// setting a column to the value it already has makes RETURNING give back the existing row, and only rows
+		// the statement inserted have no xmax
+		column := strings.TrimSpace(strings.Split(conflict, ",")[0])
+		err = tx.QueryRow(s.dialect.rebind(query)+" ON CONFLICT ("+conflict+") DO UPDATE SET "+column+" = EXCLUDED."+column+" RETURNING ID, xmax = 0",
+			args...).Scan(&id, &inserted)
+		return id, inserted, err
+	}
+	// LAST_INSERT_ID(ID) makes LastInsertId give back the existing row's ID without changing the row, so only an
+	// insert affects a row
+	result, err := tx.Exec(query+" ON DUPLICATE KEY UPDATE ID = LAST_INSERT_ID(ID)", args...)
+	if err != nil {
+		return 0, false, err
+	}
+	id, err = result.LastInsertId()
 	if err != nil {
-		log.Println("In FindReadyAlerts, problem executing statement: err", err)
+		return 0, false, err
 	}
+	affected, err := result.RowsAffected()
+	return id, affected == 1, err
+}
 
+func (s *sqlStore) DueReminders(now int64) ([]storedReminder, error) {
+	rows, err := s.db.Query(s.dialect.rebind(`select r.ID, s.ID, u.ENCRYPTED_PHONE, s.KIND, s.NTH_DAY, s.TIMEZONE, s.WEEKDAY, s.ANCHOR_DATE, s.RRULE, s.SEASON_START, s.SEASON_END, s.START_TIME, s.END_TIME,
+		s.SIDE, u.PARKED_SIDE, r.LEAD_DAYS, r.SEND_TIME, r.NEXT_CALL
+		from reminders r join schedules s on s.ID = r.SCHEDULE_ID join subscribers u on u.ID = s.SUBSCRIBER_ID
+		where r.NEXT_CALL < ? and s.DELETED_AT = 0`), now)
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
+
+	var due []storedReminder
 	for rows.Next() {
-		var id int
-		alert := alert{}
-		day := day{}
+		var r storedReminder
+		season := Season{}
+		err := rows.Scan(&r.ID, &r.ScheduleID, &r.PhoneNumber, &r.Day.Kind, &r.Day.NthWeek, &r.Timezone, &r.Day.Weekday, &r.Day.Anchor, &r.Day.RRule, &season.Start, &season.End, &r.Day.Start, &r.Day.End,
+			&r.Day.Side, &r.ParkedSide, &r.Reminder.DaysBefore, &r.Reminder.Time, &r.NextCall)
+		if err != nil {
+			return nil, err
+		}
+		r.PhoneNumber, err = decryptPhone(r.PhoneNumber)
+		if err != nil {
+			return nil, err
+		}
+		if season.Start != "" {
+			r.Day.Season = &season
+		}
+		due = append(due, r)
+	}
+	return due, rows.Err()
+}
+
+func (s *sqlStore) Save(alert alert) ([]int, error) {
+	scheduled, err := scheduleDays(alert)
+	if err != nil {
+		fmt.Println("problem calculating next call: ", err)
+		return nil, err
+	}
 
-		err := rows.Scan(&id, &alert.PhoneNumber, &day.NthWeek, &alert.Timezone, &day.Weekday)
+	encryptedPhone, index, err := encryptPhone(alert.PhoneNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	subscriberID, _, err := s.upsert(tx, "INSERT INTO subscribers (PHONE_INDEX, ENCRYPTED_PHONE, COUNTRY_CODE) VALUES (?,?,1)", "PHONE_INDEX", index, encryptedPhone)
+	if err != nil {
+		fmt.Println("problem saving subscriber: ", err)
+		tx.Rollback()
+		return nil, err
+	}
+
+	var existing []int
+	for i, sd := range scheduled {
+		t := sd.Day
+		fmt.Println("in save ..., next call: ", sd.NextCall)
+
+		var seasonStart, seasonEnd string
+		if t.Season != nil {
+			seasonStart, seasonEnd = t.Season.Start, t.Season.End
+		}
+		scheduleID, inserted, err := s.upsert(tx, "INSERT INTO schedules (SUBSCRIBER_ID, TIMEZONE, DAY_KEY, KIND, NTH_DAY, WEEKDAY, ANCHOR_DATE, RRULE, SEASON_START, SEASON_END, START_TIME, END_TIME, SIDE, NEXT_CALL) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?,?)",
+			"SUBSCRIBER_ID, TIMEZONE, DAY_KEY, REMOVED_ID",
+			subscriberID, alert.Timezone, t.key(), t.kind(), t.NthWeek, t.Weekday, t.Anchor, t.RRule, seasonStart, seasonEnd, t.Start, t.End, t.Side, sd.NextCall)
 		if err != nil {
-			log.Println("problem scanning rows: err", err)
+			fmt.Println("problem exicuting statement: ", err)
+			tx.Rollback()
+			return nil, err
 		}
+		if inserted {
+			fmt.Println("new schedule created: ", scheduleID)
+		} else {
+			fmt.Println("schedule already saved: ", scheduleID)
+			existing = append(existing, i)
+		}
+
+		for j, reminder := range t.reminders() {
+			_, _, err = s.upsert(tx, "INSERT INTO reminders (SCHEDULE_ID, LEAD_DAYS, SEND_TIME, NEXT_CALL) VALUES (?,?,?,?)",
+				"SCHEDULE_ID, LEAD_DAYS, SEND_TIME", scheduleID, reminder.DaysBefore, reminder.Time, sd.NextCalls[j])
+			if err != nil {
+				fmt.Println("problem exicuting statement: ", err)
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		if !inserted {
+			_, err = tx.Exec(s.dialect.rebind("UPDATE schedules SET NEXT_CALL = (SELECT MIN(NEXT_CALL) FROM reminders WHERE SCHEDULE_ID = ?) WHERE ID = ?"), scheduleID, scheduleID)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+	}
 
-		nextCall, err := CalculateNextCall(day.NthWeek, day.Weekday, alert.Timezone)
+	if alert.ParkedSide != "" {
+		_, err = tx.Exec(s.dialect.rebind("UPDATE subscribers SET PARKED_SIDE = ? WHERE ID = ?"), alert.ParkedSide, subscriberID)
 		if err != nil {
-			log.Println("error calculating next call: err", err)
+			fmt.Println("problem saving parked side: ", err)
+			tx.Rollback()
+			return nil, err
 		}
+	}
+	return existing, tx.Commit()
+}
+
+func (s *sqlStore) setParkedSideCommand() string {
+	if s.dialect == postgresDialect {
+		return "INSERT INTO subscribers (PHONE_INDEX, ENCRYPTED_PHONE, PARKED_SIDE) VALUES ($1,$2,$3) ON CONFLICT (PHONE_INDEX) DO UPDATE SET PARKED_SIDE = EXCLUDED.PARKED_SIDE"
+	}
+	return "INSERT INTO subscribers (PHONE_INDEX, ENCRYPTED_PHONE, PARKED_SIDE) VALUES (?,?,?) ON DUPLICATE KEY UPDATE PARKED_SIDE = VALUES(PARKED_SIDE)"
+}
+
+func (s *sqlStore) SetParkedSide(phoneNumber, side string) error {
+	encryptedPhone, index, err := encryptPhone(phoneNumber)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.setParkedSideCommand(), index, encryptedPhone, side)
+	return err
+}
+
+func (s *sqlStore) ParkedSide(phoneNumber string) (string, error) {
+	index, err := phoneIndex(phoneNumber)
+	if err != nil {
+		return "", err
+	}
+	var side string
+	err = s.db.QueryRow(s.dialect.rebind("SELECT PARKED_SIDE FROM subscribers WHERE PHONE_INDEX = ?"), index).Scan(&side)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return side, err
+}
+
+func (s *sqlStore) RecordLateReminder(l lateReminder) error {
+	encryptedPhone, index, err := encryptPhone(l.PhoneNumber)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.dialect.rebind("INSERT INTO late_reminders (REMINDER_ID, SCHEDULE_ID, PHONE_INDEX, ENCRYPTED_PHONE, DUE_AT, HANDLED_AT, OUTCOME) VALUES (?,?,?,?,?,?,?)"),
+		l.ReminderID, l.ScheduleID, index, encryptedPhone, l.DueAt, l.HandledAt, l.Outcome)
+	return err
+}
 
-		_, err = updateStmt.Exec(nextCall, id)
+func (s *sqlStore) LateReminders(since, until time.Time) ([]lateReminder, error) {
+	rows, err := s.db.Query(s.dialect.rebind(`SELECT REMINDER_ID, SCHEDULE_ID, ENCRYPTED_PHONE, DUE_AT, HANDLED_AT, OUTCOME FROM late_reminders
+		WHERE DUE_AT >= ? AND DUE_AT < ? ORDER BY DUE_AT, ID`), since.Unix(), until.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var late []lateReminder
+	for rows.Next() {
+		var l lateReminder
+		err := rows.Scan(&l.ReminderID, &l.ScheduleID, &l.PhoneNumber, &l.DueAt, &l.HandledAt, &l.Outcome)
 		if err != nil {
-			log.Println("error exicuting update statement: err", err)
+			return nil, err
 		}
+		l.PhoneNumber, err = decryptPhone(l.PhoneNumber)
+		if err != nil {
+			return nil, err
+		}
+		late = append(late, l)
+	}
+	return late, rows.Err()
+}
 
-		remind(alert.PhoneNumber, sender, id)
+func (s *sqlStore) RecordMessage(m sentMessage) error {
+	encryptedPhone, index, err := encryptPhone(m.PhoneNumber)
+	if err != nil {
+		return err
 	}
-	if err = rows.Err(); err != nil {
-		log.Println("problem iterating through the rows: ", err)
+	_, err = s.db.Exec(s.dialect.rebind("INSERT INTO messages (PHONE_INDEX, ENCRYPTED_PHONE, SCHEDULE_ID, REMINDER_ID, BODY, PROVIDER_ID, STATUS, DUE_AT, SENT_AT) VALUES (?,?,?,?,?,?,?,?,?)"),
+		index, encryptedPhone, m.ScheduleID, m.ReminderID, m.Body, m.ProviderID, m.Status, m.DueAt, m.SentAt)
+	return err
+}
+
+func (s *sqlStore) Messages(phoneNumber string, before, limit int) ([]sentMessage, error) {
+	query := "SELECT ID, ENCRYPTED_PHONE, SCHEDULE_ID, REMINDER_ID, BODY, PROVIDER_ID, STATUS, DUE_AT, SENT_AT FROM messages WHERE 1 = 1"
+	var args []interface{}
+	if phoneNumber != "" {
+		index, err := phoneIndex(phoneNumber)
+		if err != nil {
+			return nil, err
+		}
+		query += " AND PHONE_INDEX = ?"
+		args = append(args, index)
+	}
+	if before != 0 {
+		query += " AND ID < ?"
+		args = append(args, before)
+	}
+	rows, err := s.db.Query(s.dialect.rebind(query+" ORDER BY ID DESC LIMIT ?"), append(args, limit)...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
+
+	var messages []sentMessage
+	for rows.Next() {
+		var m sentMessage
+		err := rows.Scan(&m.ID, &m.PhoneNumber, &m.ScheduleID, &m.ReminderID, &m.Body, &m.ProviderID, &m.Status, &m.DueAt, &m.SentAt)
+		if err != nil {
+			return nil, err
+		}
+		m.PhoneNumber, err = decryptPhone(m.PhoneNumber)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+	return messages, rows.Err()
 }
 
-func save(alert alert) error {
-	tx, err := DB.Begin()
-	stmt, err := tx.Prepare("INSERT INTO alerts (PHONE_NUMBER, NTH_DAY, TIMEZONE, WEEKDAY, NEXT_CALL, COUNTRY_CODE) VALUES (?,?,?,?,?,1)")
+func (s *sqlStore) RecordConsent(c consentEvent) error {
+	encryptedPhone, index, err := encryptPhone(c.PhoneNumber)
 	if err != nil {
-		fmt.Println("problem preparing transaction", err)
-		err := tx.Rollback()
 		return err
 	}
+	_, err = s.db.Exec(s.dialect.rebind(`INSERT INTO consents (PHONE_INDEX, ENCRYPTED_PHONE, KIND, SOURCE, DISCLOSURE_VERSION, IP_HASH,
+		USER_AGENT_HASH, REQUEST_ID, RECORDED_AT) VALUES (?,?,?,?,?,?,?,?,?)`),
+		index, encryptedPhone, c.Kind, c.Source, c.DisclosureVersion, c.IPHash, c.UserAgentHash, c.RequestID, c.At)
+	return err
+}
 
-	for _, t := range alert.Times {
-		fmt.Println("$$$$$$$$$$$$$$$$$$$$$", t)
-		nextCall, err := CalculateNextCall(t.NthWeek, t.Weekday, alert.Timezone)
-		fmt.Println("in save ..., next call: ", nextCall)
+func (s *sqlStore) Consents(phoneNumber string) ([]consentEvent, error) {
+	query := `SELECT ID, ENCRYPTED_PHONE, KIND, SOURCE, DISCLOSURE_VERSION, IP_HASH, USER_AGENT_HASH, REQUEST_ID, RECORDED_AT FROM consents`
+	var args []interface{}
+	if phoneNumber != "" {
+		index, err := phoneIndex(phoneNumber)
+		if err != nil {
+			return nil, err
+		}
+		query += " WHERE PHONE_INDEX = ?"
+		args = append(args, index)
+	}
+	rows, err := s.db.Query(s.dialect.rebind(query+" ORDER BY ID"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	var consents []consentEvent
+	for rows.Next() {
+		var c consentEvent
+		err := rows.Scan(&c.ID, &c.PhoneNumber, &c.Kind, &c.Source, &c.DisclosureVersion, &c.IPHash, &c.UserAgentHash, &c.RequestID, &c.At)
 		if err != nil {
-			fmt.Println("problem calculating next call: ", err)
-			err := tx.Rollback()
-			return err
+			return nil, err
 		}
-		result, err := stmt.Exec(alert.PhoneNumber, t.NthWeek, alert.Timezone, t.Weekday, nextCall)
-		rowsAffected, _ := result.RowsAffected()
-		lastInsertID, _ := result.LastInsertId()
-		fmt.Println("new alert created: ", rowsAffected, lastInsertID)
+		c.PhoneNumber, err = decryptPhone(c.PhoneNumber)
 		if err != nil {
-			fmt.Println("problem exicuting statement: ", err)
-			err := tx.Rollback()
-			return err
+			return nil, err
 		}
+		consents = append(consents, c)
 	}
-	tx.Commit()
-	return nil
+	return consents, rows.Err()
 }
 
-func startDB(mysqlPassword string) *sql.DB {
-	db, err := sql.Open("mysql", mysqlPassword)
+func (s *sqlStore) PurgeMessages(before int64) (int, error) {
+	res, err := s.db.Exec(s.dialect.rebind("DELETE FROM messages WHERE SENT_AT < ?"), before)
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
+	purged, err := res.RowsAffected()
+	return int(purged), err
+}
 
-	err = db.Ping()
+func (s *sqlStore) UndeliverableSubscribers(failures int) ([]string, error) {
+	rows, err := s.db.Query(`SELECT m.PHONE_INDEX, m.ENCRYPTED_PHONE, m.STATUS FROM messages m
+		JOIN schedules s ON s.ID = m.SCHEDULE_ID
+		WHERE s.DELETED_AT = 0 ORDER BY m.PHONE_INDEX, m.ID DESC`)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	createTableCommand := `CREATE TABLE IF NOT EXISTS alerts(
-				   ID INT NOT NULL AUTO_INCREMENT,
-				   PHONE_NUMBER CHAR(10) NOT NULL,
-				   NTH_DAY INT NOT NULL,
-				   TIMEZONE VARCHAR(100) NOT NULL,
-				   WEEKDAY VARCHAR(20) NOT NULL,
-				   NEXT_CALL BIGINT NOT NULL,
-				   PRIMARY KEY  (ID)
-				)`
-	_, err = db.Exec(createTableCommand)
+	undeliverable := map[string]int{}
+	checked := map[string]bool{}
+	var phoneNumbers []string
+	for rows.Next() {
+		var index, encrypted, status string
+		err := rows.Scan(&index, &encrypted, &status)
+		if err != nil {
+			return nil, err
+		}
+		if checked[index] {
+			continue
+		}
+		if status != messageUndeliverable {
+			checked[index] = true
+			continue
+		}
+		undeliverable[index]++
+		if undeliverable[index] == failures {
+			checked[index] = true
+			phoneNumber, err := decryptPhone(encrypted)
+			if err != nil {
+				return nil, err
+			}
+			phoneNumbers = append(phoneNumbers, phoneNumber)
+		}
+	}
+	sort.Strings(phoneNumbers)
+	return phoneNumbers, rows.Err()
+}
 
+func (s *sqlStore) Reminders(timezone string, scheduleID int) ([]storedReminder, error) {
+	query := `SELECT r.ID, s.ID, u.ENCRYPTED_PHONE, s.TIMEZONE, s.KIND, s.NTH_DAY, s.WEEKDAY, s.ANCHOR_DATE, s.RRULE, s.SEASON_START, s.SEASON_END,
+		s.START_TIME, s.END_TIME, s.SIDE, r.LEAD_DAYS, r.SEND_TIME, r.NEXT_CALL
+		FROM reminders r JOIN schedules s ON s.ID = r.SCHEDULE_ID JOIN subscribers u ON u.ID = s.SUBSCRIBER_ID WHERE s.DELETED_AT = 0`
+	var args []interface{}
+	if timezone != "" {
+		query += " AND s.TIMEZONE = ?"
+		args = append(args, timezone)
+	}
+	if scheduleID != 0 {
+		query += " AND s.ID = ?"
+		args = append(args, scheduleID)
+	}
+	rows, err := s.db.Query(s.dialect.rebind(query+" ORDER BY s.ID, r.ID"), args...)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
+	defer rows.Close()
 
-	return db
+	var stored []storedReminder
+	for rows.Next() {
+		var r storedReminder
+		season := Season{}
+		err := rows.Scan(&r.ID, &r.ScheduleID, &r.PhoneNumber, &r.Timezone, &r.Day.Kind, &r.Day.NthWeek, &r.Day.Weekday, &r.Day.Anchor, &r.Day.RRule, &season.Start, &season.End,
+			&r.Day.Start, &r.Day.End, &r.Day.Side, &r.Reminder.DaysBefore, &r.Reminder.Time, &r.NextCall)
+		if err != nil {
+			return nil, err
+		}
+		r.PhoneNumber, err = decryptPhone(r.PhoneNumber)
+		if err != nil {
+			return nil, err
+		}
+		if season.Start != "" {
+			r.Day.Season = &season
+		}
+		stored = append(stored, r)
+	}
+	return stored, rows.Err()
 }
 
-func removeAlerts(alert removeAlert) error {
-	stmt, err := DB.Prepare("DELETE FROM alerts WHERE PHONE_NUMBER = ?;")
+// UpdateNextCalls also keeps each schedule's NEXT_CALL at the soonest of its reminders'.
+func (s *sqlStore) UpdateNextCalls(changes []nextCallChange) ([]nextCallChange, error) {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var skipped []nextCallChange
+	for _, c := range changes {
+		// mysql counts the rows it changed rather than the ones it matched, so a change to the same next call
+		// would look skipped
+		if c.New == c.Old {
+			continue
+		}
+		res, err := tx.Exec(s.dialect.rebind("UPDATE reminders SET NEXT_CALL = ? WHERE ID = ? AND NEXT_CALL = ?"), c.New, c.ReminderID, c.Old)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if affected == 0 {
+			skipped = append(skipped, c)
+			continue
+		}
+		_, err = tx.Exec(s.dialect.rebind("UPDATE schedules SET NEXT_CALL = (SELECT MIN(NEXT_CALL) FROM reminders WHERE SCHEDULE_ID = ?) WHERE ID = ?"), c.ScheduleID, c.ScheduleID)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	return skipped, tx.Commit()
+}
+
+func (s *sqlStore) HasSideSchedules(phoneNumber string) (bool, error) {
+	index, err := phoneIndex(phoneNumber)
+	if err != nil {
+		return false, err
 	}
+	var count int
+	err = s.db.QueryRow(s.dialect.rebind(`SELECT COUNT(*) FROM schedules s JOIN subscribers u ON u.ID = s.SUBSCRIBER_ID
+		WHERE u.PHONE_INDEX = ? AND s.SIDE <> '' AND s.DELETED_AT = 0`), index).Scan(&count)
+	return count > 0, err
+}
 
-	res, err := stmt.Exec(alert.PhoneNumber)
+func (s *sqlStore) Remove(phoneNumber string, why removal) error {
+	index, err := phoneIndex(phoneNumber)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	res, err := tx.Exec(s.dialect.rebind(`UPDATE schedules SET DELETED_AT = ?, DELETE_REASON = ?, DELETE_REQUEST_ID = ?, REMOVED_ID = ID
+		WHERE DELETED_AT = 0 AND SUBSCRIBER_ID IN (SELECT ID FROM subscribers WHERE PHONE_INDEX = ?)`), why.At, why.Reason, why.RequestID, index)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 	affected, err := res.RowsAffected()
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 	fmt.Println("rows affected: ", affected)
-	return nil
+
+	_, err = tx.Exec(s.dialect.rebind("UPDATE subscribers SET PARKED_SIDE = '' WHERE PHONE_INDEX = ?"), index)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) RemoveSchedule(phoneNumber string, scheduleID int, why removal) (bool, error) {
+	index, err := phoneIndex(phoneNumber)
+	if err != nil {
+		return false, err
+	}
+	res, err := s.db.Exec(s.dialect.rebind(`UPDATE schedules SET DELETED_AT = ?, DELETE_REASON = ?, DELETE_REQUEST_ID = ?, REMOVED_ID = ID
+		WHERE ID = ? AND DELETED_AT = 0 AND SUBSCRIBER_ID IN (SELECT ID FROM subscribers WHERE PHONE_INDEX = ?)`),
+		why.At, why.Reason, why.RequestID, scheduleID, index)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+// Restore checks each removed schedule for one of the same day that hasn't been removed before restoring it, since
+// restoring it too would break the unique key.
+func (s *sqlStore) Restore(phoneNumber string, scheduleID int) ([]int, error) {
+	index, err := phoneIndex(phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT s.ID, s.SUBSCRIBER_ID, s.TIMEZONE, s.DAY_KEY FROM schedules s JOIN subscribers u ON u.ID = s.SUBSCRIBER_ID
+		WHERE u.PHONE_INDEX = ? AND s.DELETED_AT <> 0`
+	args := []interface{}{index}
+	if scheduleID != 0 {
+		query += " AND s.ID = ?"
+		args = append(args, scheduleID)
+	}
+	// if a day was removed more than once, restore the latest
+	rows, err := tx.Query(s.dialect.rebind(query+" ORDER BY s.DELETED_AT DESC, s.ID"), args...)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	type removedSchedule struct {
+		id, subscriberID int
+		timezone, dayKey string
+	}
+	var removed []removedSchedule
+	for rows.Next() {
+		var r removedSchedule
+		err := rows.Scan(&r.id, &r.subscriberID, &r.timezone, &r.dayKey)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			return nil, err
+		}
+		removed = append(removed, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	var restored []int
+	for _, r := range removed {
+		var count int
+		err := tx.QueryRow(s.dialect.rebind("SELECT COUNT(*) FROM schedules WHERE SUBSCRIBER_ID = ? AND TIMEZONE = ? AND DAY_KEY = ? AND DELETED_AT = 0"),
+			r.subscriberID, r.timezone, r.dayKey).Scan(&count)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if count > 0 {
+			continue
+		}
+		err = s.moveOnRestored(tx, r.id)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		_, err = tx.Exec(s.dialect.rebind("UPDATE schedules SET DELETED_AT = 0, DELETE_REASON = '', DELETE_REQUEST_ID = '', REMOVED_ID = 0 WHERE ID = ?"), r.id)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		restored = append(restored, r.id)
+	}
+	return restored, tx.Commit()
+}
+
+// moveOnRestored moves the reminders of the removed schedule with ID scheduleID whose next call went by while it was
+// removed on to their next sweeping day, in tx, before it is restored.
+func (s *sqlStore) moveOnRestored(tx *sql.Tx, scheduleID int) error {
+	rows, err := tx.Query(s.dialect.rebind(`SELECT r.ID, s.TIMEZONE, s.KIND, s.NTH_DAY, s.WEEKDAY, s.ANCHOR_DATE, s.RRULE, s.SEASON_START, s.SEASON_END,
+		s.START_TIME, s.END_TIME, s.SIDE, r.LEAD_DAYS, r.SEND_TIME
+		FROM reminders r JOIN schedules s ON s.ID = r.SCHEDULE_ID WHERE s.ID = ? AND r.NEXT_CALL <= ?`), scheduleID, Now().Unix())
+	if err != nil {
+		return err
+	}
+	var changes []nextCallChange
+	for rows.Next() {
+		var r storedReminder
+		season := Season{}
+		err := rows.Scan(&r.ID, &r.Timezone, &r.Day.Kind, &r.Day.NthWeek, &r.Day.Weekday, &r.Day.Anchor, &r.Day.RRule, &season.Start, &season.End,
+			&r.Day.Start, &r.Day.End, &r.Day.Side, &r.Reminder.DaysBefore, &r.Reminder.Time)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if season.Start != "" {
+			r.Day.Season = &season
+		}
+		changes = append(changes, nextCallChange{ReminderID: r.ID, ScheduleID: scheduleID, New: restoredNextCall(r.Day, r.Reminder, r.Timezone)})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+
+	for _, c := range changes {
+		_, err = tx.Exec(s.dialect.rebind("UPDATE reminders SET NEXT_CALL = ? WHERE ID = ?"), c.New, c.ReminderID)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(s.dialect.rebind("UPDATE schedules SET NEXT_CALL = (SELECT MIN(NEXT_CALL) FROM reminders WHERE SCHEDULE_ID = ?) WHERE ID = ?"), scheduleID, scheduleID)
+	return err
+}
+
+func (s *sqlStore) PurgeRemoved(before int64) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	rows, err := tx.Query(s.dialect.rebind("SELECT DISTINCT SUBSCRIBER_ID FROM schedules WHERE DELETED_AT <> 0 AND DELETED_AT < ?"), before)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	var subscriberIDs []int
+	for rows.Next() {
+		var id int
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			tx.Rollback()
+			return 0, err
+		}
+		subscriberIDs = append(subscriberIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	res, err := tx.Exec(s.dialect.rebind("DELETE FROM schedules WHERE DELETED_AT <> 0 AND DELETED_AT < ?"), before)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	purged, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	for _, id := range subscriberIDs {
+		_, err = tx.Exec(s.dialect.rebind("DELETE FROM subscribers WHERE ID = ? AND NOT EXISTS (SELECT 1 FROM schedules WHERE SUBSCRIBER_ID = ?)"), id, id)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	return int(purged), tx.Commit()
+}
+
+func (s *sqlStore) Forget(phoneNumber string) error {
+	index, err := phoneIndex(phoneNumber)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	// the subscriber's schedules and their reminders go with it. The consent ledger is kept.
+	for _, table := range []string{"subscribers", "late_reminders", "messages"} {
+		_, err = tx.Exec(s.dialect.rebind("DELETE FROM "+table+" WHERE PHONE_INDEX = ?"), index)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Schedules(phoneNumber string) ([]storedSchedule, error) {
+	return s.schedules(phoneNumber, false)
+}
+
+func (s *sqlStore) RemovedSchedules(phoneNumber string) ([]storedSchedule, error) {
+	return s.schedules(phoneNumber, true)
+}
+
+// schedules returns phoneNumber's removed schedules, or the ones that haven't been removed.
+func (s *sqlStore) schedules(phoneNumber string, removed bool) ([]storedSchedule, error) {
+	index, err := phoneIndex(phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	deleted := "s.DELETED_AT = 0"
+	if removed {
+		deleted = "s.DELETED_AT <> 0"
+	}
+	rows, err := s.db.Query(s.dialect.rebind(`SELECT s.ID, s.TIMEZONE, s.KIND, s.NTH_DAY, s.WEEKDAY, s.ANCHOR_DATE, s.RRULE, s.SEASON_START, s.SEASON_END,
+		s.START_TIME, s.END_TIME, s.SIDE, s.NEXT_CALL, s.DELETED_AT, s.DELETE_REASON, s.DELETE_REQUEST_ID, r.LEAD_DAYS, r.SEND_TIME
+		FROM schedules s JOIN subscribers u ON u.ID = s.SUBSCRIBER_ID JOIN reminders r ON r.SCHEDULE_ID = s.ID
+		WHERE u.PHONE_INDEX = ? AND `+deleted+` ORDER BY s.ID, r.ID`), index)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var schedules []storedSchedule
+	for rows.Next() {
+		var sc storedSchedule
+		var reminder Reminder
+		var why removal
+		season := Season{}
+		err := rows.Scan(&sc.ID, &sc.Timezone, &sc.Day.Kind, &sc.Day.NthWeek, &sc.Day.Weekday, &sc.Day.Anchor, &sc.Day.RRule, &season.Start, &season.End,
+			&sc.Day.Start, &sc.Day.End, &sc.Day.Side, &sc.NextCall, &why.At, &why.Reason, &why.RequestID, &reminder.DaysBefore, &reminder.Time)
+		if err != nil {
+			return nil, err
+		}
+		// one row per reminder, so the reminders of a schedule follow each other
+		if len(schedules) > 0 && schedules[len(schedules)-1].ID == sc.ID {
+			last := &schedules[len(schedules)-1]
+			last.Day.Reminders = append(last.Day.Reminders, reminder)
+			continue
+		}
+		if season.Start != "" {
+			sc.Day.Season = &season
+		}
+		if why.At != 0 {
+			sc.Removed = &why
+		}
+		sc.Day.Reminders = []Reminder{reminder}
+		schedules = append(schedules, sc)
+	}
+	return schedules, rows.Err()
+}
+
+// reencryptPhones encrypts the phone numbers in table that weren't encrypted with the current key again with it,
+// and returns how many it did.
+func (s *sqlStore) reencryptPhones(table string) (int, error) {
+	rows, err := s.db.Query(s.dialect.rebind("SELECT ID, ENCRYPTED_PHONE FROM "+table+" WHERE ENCRYPTED_PHONE NOT LIKE ?"), phoneKeys.current+":%")
+	if err != nil {
+		return 0, err
+	}
+	old := map[int]string{}
+	for rows.Next() {
+		var id int
+		var encrypted string
+		err := rows.Scan(&id, &encrypted)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		old[id] = encrypted
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for id, encrypted := range old {
+		if phoneKeys.encryptedWithCurrent(encrypted) {
+			continue
+		}
+		phoneNumber, err := phoneKeys.decrypt(encrypted)
+		if err != nil {
+			return rotated, fmt.Errorf("row %d: %v", id, err)
+		}
+		reencrypted, err := phoneKeys.encrypt(phoneNumber)
+		if err != nil {
+			return rotated, err
+		}
+		// leave the row alone if it changed since we read it
+		res, err := s.db.Exec(s.dialect.rebind("UPDATE "+table+" SET ENCRYPTED_PHONE = ? WHERE ID = ? AND ENCRYPTED_PHONE = ?"), reencrypted, id, encrypted)
+		if err != nil {
+			return rotated, err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return rotated, err
+		}
+		rotated += int(affected)
+	}
+	return rotated, nil
 }
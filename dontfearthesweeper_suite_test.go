@@ -5,12 +5,14 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"net/http"
 	"testing"
 	"time"
 )
 
 var MockEnv = Env{
 	MsgSvc: &MockMessageService{},
+	Store:  NewMemoryStore(),
 }
 
 func TestDontfearthesweeper(t *testing.T) {
@@ -22,13 +24,15 @@ type MockMessageService struct {
 	from string
 	to   string
 	body string
+	// badSignature makes CheckRequest say requests aren't from twilio.
+	badSignature bool
 }
 
-func (t *MockMessageService) Send(from, to, body string) error {
+func (t *MockMessageService) Send(from, to, body string) (string, error) {
 	t.from = from
 	t.to = to
 	t.body = body
-	return nil
+	return "SM" + to, nil
 }
 
 func (t *MockMessageService) RequestCode(phoneNumber string) (bool, error) {
@@ -39,6 +43,10 @@ func (t *MockMessageService) VerifyCode(phoneNumber, code string) (bool, error)
 	return true, nil
 }
 
+func (t *MockMessageService) CheckRequest(r *http.Request) (bool, error) {
+	return !t.badSignature, r.ParseForm()
+}
+
 func MockNow(t time.Time) func() {
 	oldNow := Now
 	Now = func() time.Time {
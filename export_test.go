@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// MockHolidayCalendars saves the holiday calendars that are loaded now, for a test that loads its own, and returns
+// the function that puts them back.
+func MockHolidayCalendars() func() {
+	holidays.RLock()
+	path, byTimezone := holidays.path, holidays.byTimezone
+	holidays.RUnlock()
+	return func() {
+		holidays.Lock()
+		holidays.path, holidays.byTimezone = path, byTimezone
+		holidays.Unlock()
+	}
+}
+
+// MockCatchUpPolicy sets the catch-up policy, like STREETSWEEP_CATCHUP_POLICY does, and returns the function that
+// puts the old one back.
+func MockCatchUpPolicy(policy string) func() {
+	old := catchUpPolicy
+	catchUpPolicy = policy
+	return func() {
+		catchUpPolicy = old
+	}
+}
+
+// The handlers below aren't exported, since only the router needs them; these let the specs call them.
+
+func (env *Env) ParkedSideHandler(w http.ResponseWriter, r *http.Request) {
+	env.parkedSideHandler(w, r)
+}
+
+func (env *Env) IncomingSMSHandler(w http.ResponseWriter, r *http.Request) {
+	env.incomingSMSHandler(w, r)
+}
+
+func (env *Env) AdminAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	env.adminAlertsHandler(w, r)
+}
+
+// FailingSaveStore is a store that can't save alerts, like when the database is down.
+type FailingSaveStore struct {
+	AlertStore
+}
+
+func (FailingSaveStore) Save(a alert) ([]int, error) {
+	return nil, errors.New("the database is down")
+}
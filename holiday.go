@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// holidayCalendar is the days that one city doesn't sweep on. It is read from a YAML file that maps each timezone
+// to the calendar of the city whose users are in that timezone, like:
+//
+//	America/Los_Angeles:
+//	  federal: true
+//	  dates:
+//	    - 2017-11-24
+//	    - 2017-12-26
+type holidayCalendar struct {
+	Federal bool     `yaml:"federal"`
+	Dates   []string `yaml:"dates"`
+
+	dates map[string]bool
+}
+
+// holidayCalendars holds every city's holiday calendar. It can be reloaded while the scheduler is using it.
+type holidayCalendars struct {
+	sync.RWMutex
+	path       string
+	byTimezone map[string]*holidayCalendar
+}
+
+var holidays = &holidayCalendars{}
+
+// LoadHolidayCalendars reads the holiday calendars from the YAML file at path. Later calls to reload read the same
+// file again.
+func LoadHolidayCalendars(path string) error {
+	holidays.Lock()
+	holidays.path = path
+	holidays.Unlock()
+	return holidays.reload()
+}
+
+// reload reads the calendar file again. If the file can't be read, the calendars that were already loaded are kept.
+func (h *holidayCalendars) reload() error {
+	h.RLock()
+	path := h.path
+	h.RUnlock()
+	if path == "" {
+		return fmt.Errorf("no holiday calendar file configured")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var byTimezone map[string]*holidayCalendar
+	err = yaml.Unmarshal(data, &byTimezone)
+	if err != nil {
+		return fmt.Errorf("problem parsing %s: %v", path, err)
+	}
+
+	for timezone, calendar := range byTimezone {
+		if _, err := time.LoadLocation(timezone); err != nil {
+			return fmt.Errorf("unknown timezone %q in %s", timezone, path)
+		}
+		if calendar == nil {
+			return fmt.Errorf("empty holiday calendar for %s in %s", timezone, path)
+		}
+		calendar.dates = make(map[string]bool)
+		for _, date := range calendar.Dates {
+			if _, err := time.Parse(anchorLayout, date); err != nil {
+				return fmt.Errorf("holiday %q for %s in %s isn't a date like 2017-11-24", date, timezone, path)
+			}
+			calendar.dates[date] = true
+		}
+	}
+
+	h.Lock()
+	h.byTimezone = byTimezone
+	h.Unlock()
+	return nil
+}
+
+// isHoliday reports whether the city for timezone doesn't sweep on day.
+func (h *holidayCalendars) isHoliday(timezone string, day time.Time) bool {
+	h.RLock()
+	calendar := h.byTimezone[timezone]
+	h.RUnlock()
+	if calendar == nil {
+		return false
+	}
+	return calendar.dates[day.Format(anchorLayout)] || calendar.Federal && isFederalHoliday(day)
+}
+
+// isFederalHoliday reports whether day is a US federal holiday, using the day it is observed on when it falls on
+// a weekend.
+func isFederalHoliday(day time.Time) bool {
+	// new year's day can be observed on december 31st of the year before
+	for _, year := range []int{day.Year(), day.Year() + 1} {
+		for _, holiday := range federalHolidays(year, day.Location()) {
+			if holiday.Year() == day.Year() && holiday.YearDay() == day.YearDay() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// federalHolidays returns the observed US federal holidays for year.
+func federalHolidays(year int, location *time.Location) []time.Time {
+	fixed := func(month time.Month, day int) time.Time {
+		return observed(time.Date(year, month, day, 0, 0, 0, 0, location))
+	}
+	nth := func(month time.Month, nthWeek int, weekday time.Weekday) time.Time {
+		day, _ := nthDayOfMonth(time.Date(year, month, 1, 0, 0, 0, 0, location), nthWeek, int(weekday))
+		return day
+	}
+
+	days := []time.Time{
+		fixed(time.January, 1),               // New Year's Day
+		nth(time.January, 3, time.Monday),    // Martin Luther King Jr. Day
+		nth(time.February, 3, time.Monday),   // Washington's Birthday
+		nth(time.May, lastWeek, time.Monday), // Memorial Day
+		fixed(time.July, 4),                  // Independence Day
+		nth(time.September, 1, time.Monday),  // Labor Day
+		nth(time.October, 2, time.Monday),    // Columbus Day
+		fixed(time.November, 11),             // Veterans Day
+		nth(time.November, 4, time.Thursday), // Thanksgiving Day
+		fixed(time.December, 25),             // Christmas Day
+	}
+	if year >= 2021 {
+		days = append(days, fixed(time.June, 19)) // Juneteenth
+	}
+	return days
+}
+
+// observed moves a holiday that falls on a saturday to the friday before, and one on a sunday to the monday after.
+func observed(day time.Time) time.Time {
+	switch day.Weekday() {
+	case time.Saturday:
+		return day.AddDate(0, 0, -1)
+	case time.Sunday:
+		return day.AddDate(0, 0, 1)
+	}
+	return day
+}
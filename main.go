@@ -1,20 +1,21 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
+	"github.com/nytimes/gziphandler"
 	"io"
+	"math"
 	"net/http"
 	"os"
 	"time"
-	"github.com/nytimes/gziphandler"
-
-	"database/sql"
 
 	"net/http/httputil"
 
 	"github.com/dcu/go-authy"
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 	"github.com/sfreiberg/gotwilio"
 
 	"log"
@@ -23,16 +24,14 @@ import (
 // Env contains the interfaces for any external API's used. This way we can mock out those API's in tests.
 type Env struct {
 	MsgSvc MessageServicer
+	Store  AlertStore
+
+	// AdminToken is the bearer token for the /admin endpoints. If it is empty, those endpoints are turned off.
+	AdminToken string
 }
 
 var (
 	//All global environment variables should be set at the beginning of the application, then remain unchanged.
-
-	// DB is a database handle representing a pool of zero or more
-	// underlying connections. It's safe for concurrent use by multiple
-	// goroutines.
-	// **(from sql package)**
-	DB   *sql.DB
 	from string
 )
 
@@ -42,36 +41,123 @@ type startVerification struct {
 }
 
 type alert struct {
-	Timezone    string `json:"timezone"`
-	Times       []day  `json:"times"`
-	PhoneNumber string `json:"phoneNumber"`
-	Token       string `json:"token"`
+	Timezone    string     `json:"timezone"`
+	Times       []Day      `json:"times"`
+	Season      *Season    `json:"season,omitempty"`
+	Reminders   []Reminder `json:"reminders,omitempty"`
+	ParkedSide  string     `json:"parkedSide,omitempty"`
+	PhoneNumber string     `json:"phoneNumber"`
+	Token       string     `json:"token"`
+}
+
+// days returns the alert's times with the alert's season and reminders filled in for any time that doesn't have
+// its own.
+func (a alert) days() []Day {
+	days := make([]Day, len(a.Times))
+	for i, d := range a.Times {
+		if d.Season == nil {
+			d.Season = a.Season
+		}
+		if len(d.Reminders) == 0 {
+			d.Reminders = a.Reminders
+		}
+		days[i] = d
+	}
+	return days
 }
 
 type removeAlert struct {
 	PhoneNumber string `json:"phoneNumber"`
 	Token       string `json:"token"`
+	// ScheduleID is the one schedule to stop. Without it, all of PhoneNumber's schedules stop.
+	ScheduleID int `json:"scheduleId"`
 }
 
-type day struct {
-	Weekday int `json:"weekday"`
-	NthWeek int `json:"nthWeek"`
+// validate checks that an alert has a real timezone and only days that CalculateNextCall knows how to handle.
+func (a alert) validate() error {
+	if _, err := time.LoadLocation(a.Timezone); a.Timezone == "" || err != nil {
+		return fmt.Errorf("unknown timezone %q", a.Timezone)
+	}
+	if len(a.Times) == 0 {
+		return fmt.Errorf("no sweeping days given")
+	}
+	location, _ := time.LoadLocation(a.Timezone)
+	days := a.days()
+	hasSides := false
+	for i, d := range days {
+		hasSides = hasSides || d.Side != ""
+		if err := d.validate(); err != nil {
+			return err
+		}
+		for _, other := range days[:i] {
+			if d.overlaps(other, location) {
+				return fmt.Errorf("sweeping from %s to %s overlaps sweeping from %s to %s on the same day", d.Start, d.End, other.Start, other.End)
+			}
+		}
+	}
+	if hasSides && !validSide(a.ParkedSide) {
+		return fmt.Errorf("parkedSide must be %q or %q when sweeping days have a side", sideOdd, sideEven)
+	}
+	if !hasSides && a.ParkedSide != "" {
+		return fmt.Errorf("parkedSide was given but none of the sweeping days have a side")
+	}
+	return nil
 }
 
 func init() {
 	from = os.Getenv("TWILIO_PHONE_NUMBER")
-	if from == "" {
-		log.Fatal("TWILIO_PHONE_NUMBER environment variable not set")
+}
+
+func main() {
+	// commands that calculate reminders need the holidays too, so load them first
+	holidaysFile := os.Getenv("STREETSWEEP_HOLIDAYS_FILE")
+	if holidaysFile != "" {
+		err := LoadHolidayCalendars(holidaysFile)
+		if err != nil {
+			log.Fatal("problem loading holiday calendars: ", err)
+		}
 	}
 
-	mysqlPassword := os.Getenv("MYSQL_PASSWORD")
-	if mysqlPassword == "" {
-		log.Fatal("MYSQL_PASSWORD environment variable not set")
+	// the store and the migrations need the phone number keys
+	keys, err := parsePhoneKeys(os.Getenv("STREETSWEEP_PHONE_KEYS"), os.Getenv("STREETSWEEP_PHONE_INDEX_KEY"))
+	if err != nil {
+		log.Fatal("problem reading the phone number keys: ", err)
 	}
-	DB = startDB(mysqlPassword)
-}
+	phoneKeys = keys
 
-func main() {
+	// MYSQL_PASSWORD has always held the whole MySQL DSN, so it still works as one
+	dsn := os.Getenv("DATABASE_URL")
+	if dsn == "" {
+		dsn = os.Getenv("MYSQL_PASSWORD")
+	}
+	if dsn == "" {
+		log.Fatal("DATABASE_URL environment variable not set")
+	}
+	store, err := openSQLStore(dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	env := Env{Store: store}
+
+	// the migrate command decides for itself which migrations to run
+	if len(os.Args) < 2 || os.Args[1] != "migrate" {
+		err := store.migrateUp(migrations[len(migrations)-1].Version)
+		if err != nil {
+			log.Fatal("problem migrating the database: ", err)
+		}
+	}
+
+	if len(os.Args) > 1 {
+		err := runCommand(&env, os.Args[1], os.Args[2:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if from == "" {
+		log.Fatal("TWILIO_PHONE_NUMBER environment variable not set")
+	}
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -93,17 +179,35 @@ func main() {
 	}
 
 	msgSvc := twilioMessageService{
-		twilio: gotwilio.NewTwilioClient(twilioID, twilioAuthToken),
-		authy:  authy.NewAuthyAPI(authyAPIKey),
+		twilio:  gotwilio.NewTwilioClient(twilioID, twilioAuthToken),
+		authy:   authy.NewAuthyAPI(authyAPIKey),
+		baseURL: os.Getenv("STREETSWEEP_BASE_URL"),
 	}
 
-	env := Env{
-		MsgSvc: &msgSvc,
+	if policy := os.Getenv("STREETSWEEP_CATCHUP_POLICY"); policy != "" {
+		if !validCatchUpPolicy(policy) {
+			log.Fatalf("STREETSWEEP_CATCHUP_POLICY must be %q, %q or %q", catchUpSend, catchUpSkip, catchUpApologize)
+		}
+		catchUpPolicy = policy
 	}
 
+	retention, err := retentionPolicyFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	env.MsgSvc = &msgSvc
+	env.AdminToken = os.Getenv("STREETSWEEP_ADMIN_TOKEN")
+
 	go func() {
 		for range time.Tick(10 * time.Second) {
-			FindReadyAlerts(env.MsgSvc)
+			env.FindReadyAlerts()
+		}
+	}()
+
+	go func() {
+		for range time.Tick(retentionInterval) {
+			env.runRetention(retention)
 		}
 	}()
 
@@ -127,7 +231,18 @@ func main() {
 	http.Handle("/remove", http.StripPrefix("/remove", http.FileServer(http.Dir("./public/remove"))))
 	http.HandleFunc("/verification/start", env.verificationStartHandler)
 	http.HandleFunc("/verification/verify", env.VerificationVerifyHandler)
+	http.HandleFunc("/alerts/preview", env.PreviewHandler)
 	http.HandleFunc("/alerts/stop", env.stopAlertHandler)
+	http.HandleFunc("/alerts/side", env.parkedSideHandler)
+	http.HandleFunc("/messages/history", env.messageHistoryHandler)
+	http.HandleFunc("/subscriber/export", env.subscriberExportHandler)
+	http.HandleFunc("/subscriber/delete", env.subscriberDeleteHandler)
+	http.HandleFunc("/sms/incoming", env.incomingSMSHandler)
+	http.HandleFunc("/admin/holidays/reload", env.reloadHolidaysHandler)
+	http.HandleFunc("/admin/messages", env.adminMessagesHandler)
+	http.HandleFunc("/admin/alerts", env.adminAlertsHandler)
+	http.HandleFunc("/admin/alerts/", env.adminAlertsHandler)
+	http.HandleFunc("/admin/consents", env.adminConsentsHandler)
 	log.Println("Magic happening on port " + port)
 	log.Fatal(http.ListenAndServe(":"+port, nil))
 }
@@ -159,17 +274,68 @@ func (env *Env) stopAlertHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = removeAlerts(t)
+	if t.ScheduleID != 0 {
+		found, err := env.Store.RemoveSchedule(t.PhoneNumber, t.ScheduleID, newRemoval(removedOnWeb, requestID(r)))
+		if err != nil {
+			log.Println("problem deleting schedule from database: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "oops! we made a mistake")
+			return
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "no such schedule")
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	err = env.Store.Remove(t.PhoneNumber, newRemoval(removedOnWeb, requestID(r)))
 	if err != nil {
 		log.Println("problem deleting alert to database: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		io.WriteString(w, "oops! we made a mistake")
 		return
 	}
+	env.recordOptOut(webConsent(r, t.PhoneNumber, consentOptOut))
 
 	w.WriteHeader(http.StatusOK)
 }
 
+// isAdmin checks that the request has the admin bearer token.
+func (env *Env) isAdmin(r *http.Request) bool {
+	if env.AdminToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+env.AdminToken)) == 1
+}
+
+// reloadHolidaysHandler reads the holiday calendar file again so that changes to it take effect without a restart.
+// Alerts that already have a NEXT_CALL keep it; the new calendar is used from their next reminder on.
+func (env *Env) reloadHolidaysHandler(w http.ResponseWriter, r *http.Request) {
+	if !env.isAdmin(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, "not authorized")
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := holidays.reload()
+	if err != nil {
+		log.Println("problem reloading holiday calendars: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	log.Println("reloaded holiday calendars")
+	w.WriteHeader(http.StatusOK)
+}
+
 func (env *Env) verificationStartHandler(w http.ResponseWriter, r *http.Request) {
 	requestDump, err := httputil.DumpRequest(r, true)
 	if err != nil {
@@ -217,6 +383,14 @@ func (env *Env) VerificationVerifyHandler(w http.ResponseWriter, r *http.Request
 	}
 	defer r.Body.Close()
 
+	err = t.validate()
+	if err != nil {
+		log.Println("invalid alert: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
 	verified, err := env.MsgSvc.VerifyCode(t.PhoneNumber, t.Token)
 	if !verified {
 		//todo: do this better. figure out all the ways that CheckPhoneVerification could fail and handle all of them well
@@ -225,7 +399,7 @@ func (env *Env) VerificationVerifyHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = save(t)
+	existing, err := env.Store.Save(t)
 	if err != nil {
 		log.Println("problem saving new alert to database: ", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -233,7 +407,28 @@ func (env *Env) VerificationVerifyHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	// the opt in is only recorded once there is an alert they opted in to. We can't text anyone without proof they
+	// opted in, so if it can't be recorded they get an error, and signing up again records it.
+	err = env.Store.RecordConsent(webConsent(r, t.PhoneNumber, consentOptIn))
+	if err != nil {
+		log.Println("problem recording consent: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "oops! we made a mistake")
+		return
+	}
+
+	// signing up again is fine, but tell them which times they already had
+	if existing == nil {
+		existing = []int{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(saveResult{AlreadySaved: existing})
+}
+
+// saveResult is what VerificationVerifyHandler answers with. AlreadySaved has the indexes in the alert's times of the
+// ones that were already saved.
+type saveResult struct {
+	AlreadySaved []int `json:"alreadySaved"`
 }
 
 // Now provides a rapper to time.Now and can be used to mock calls to time.Now in tests.
@@ -241,46 +436,125 @@ var Now = func() time.Time {
 	return time.Now()
 }
 
-// CalculateNextCall takes an nth week (first, second, third, forth), a weekday, and a timezone and calculates
-// the next time that a person should be alerted for street sweeping.
-func CalculateNextCall(nthWeek int, weekday int, timezone string) (int64, error) {
-
-	var NextCallUnixTime int64
+// reminderMessage is the text for a reminder sent daysBefore days ahead of sweeping on sweepDay. daysBefore is
+// counted from when the text actually goes out, which can be later than the reminder was due.
+func reminderMessage(d Day, daysBefore int, sweepDay time.Time) string {
+	when := "tomorrow"
+	switch daysBefore {
+	case 0:
+		when = "today"
+	case 1:
+	default:
+		when = "on " + sweepDay.Format("Monday, Jan 2")
+	}
+	if d.Start != "" {
+		when += " " + formatClock(d.Start) + "-" + formatClock(d.End)
+	}
+	if d.Side != "" {
+		when = "on the " + d.Side + " side " + when
+	}
+	return "Don't forget about street sweeping " + when + "! (to stop getting these reminders, go to dontfearthesweeper.com/remove or email ouidevelop@gmail.com)"
+}
 
-	location, err := time.LoadLocation(timezone)
+// FindReadyAlerts finds all reminders that are ready to be sent (that is, that has a "next call" that is before
+// now), and sends a text message reminder for each of them. An alert can have more than one reminder for the same
+// sweeping day, and each one moves on to its own next call independently of the others.
+func (env *Env) FindReadyAlerts() {
+	due, err := env.Store.DueReminders(Now().Unix())
 	if err != nil {
-		return NextCallUnixTime, err
+		log.Println("In FindReadyAlerts, problem finding due reminders: err", err)
+		return
 	}
-
-	now := Now().In(location)
-	timeToSendMessageThisMonth := timeAtNthDayOfMonth(now, nthWeek, weekday, 19)
-	if now.After(timeToSendMessageThisMonth) { // if right now is after the time to send a message this month
-		dateNextMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).AddDate(0, 1, 0)
-		timeToSendMessageThisMonth = timeAtNthDayOfMonth(dateNextMonth, nthWeek, weekday, 19)
-		if now.After(timeToSendMessageThisMonth) {
-			dateInTwoMonths := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location()).AddDate(0, 2, 0)
-			timeToSendMessageThisMonth = timeAtNthDayOfMonth(dateInTwoMonths, nthWeek, weekday, 19)
+	// the sweeping days apologized for so far, so that a schedule with more than one reminder gets one apology
+	apologized := map[string]bool{}
+
+	for _, r := range due {
+		day := r.Day
+
+		// move on from the sweeping day this reminder was for, not from now, so that if we're running late the
+		// sweeping days we missed still come up and go through catchUp instead of being skipped
+		nextCall, err := NextCallAfter(day, r.Reminder, r.Timezone, r.NextCall)
+		if err != nil {
+			// a call from further back than the search horizon has nothing to catch up on, so start over from now
+			nextCall, err = calculateReminderCall(day, r.Reminder, r.Timezone)
+		}
+		if err != nil {
+			// an rrule with a COUNT or UNTIL can run out of days. Park it so it isn't picked up again every tick.
+			log.Println("error calculating next call: err", err)
+			nextCall = math.MaxInt64
 		}
-	}
 
-	NextCallUnixTime = timeToSendMessageThisMonth.Unix()
+		skipped, err := env.Store.UpdateNextCalls([]nextCallChange{{ReminderID: r.ID, ScheduleID: r.ScheduleID, Timezone: r.Timezone, Old: r.NextCall, New: nextCall}})
+		if err != nil {
+			log.Println("error updating next call: err", err)
+		}
+		if len(skipped) > 0 {
+			// something else, like another dyno's FindReadyAlerts, moved it on first, and sends it
+			log.Println("reminder ", r.ID, " for alert ", r.ScheduleID, " was already handled")
+			continue
+		}
 
-	return NextCallUnixTime, nil
-}
+		if !remindsSide(day.Side, r.ParkedSide) {
+			log.Println("not reminding ", r.ScheduleID, " about the ", day.Side, " side, they're parked on the ", r.ParkedSide, " side")
+			continue
+		}
 
-func timeAtNthDayOfMonth(t time.Time, nthDay int, weekday int, hour int) time.Time {
-	firstDayOfThisMonth := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
-	dateOfFirstWeekday := ((weekday+7)-int(firstDayOfThisMonth.Weekday()))%7 + 1
-	dateOfNthWeekday := dateOfFirstWeekday + ((nthDay - 1) * 7)
-	TimeAtNthDayOfMonth := time.Date(t.Year(), t.Month(), dateOfNthWeekday, hour, 0, 0, 0, t.Location())
-	return TimeAtNthDayOfMonth.Add(-24 * time.Hour)
+		location, err := time.LoadLocation(r.Timezone)
+		if err != nil {
+			log.Println("problem loading timezone: err", err)
+			location = time.UTC
+		}
+		dueAt := time.Unix(r.NextCall, 0).In(location)
+		now := Now().In(location)
+		sweepDay := r.Reminder.sweepDay(dueAt)
+		message := reminderMessage(day, daysBetween(now, sweepDay), sweepDay)
+
+		message, outcome := catchUp(catchUpPolicy, day, message, sweepDay, dueAt, now)
+		if outcome == outcomeApologized {
+			key := fmt.Sprintf("%d %s", r.ScheduleID, sweepDay.Format("2006-01-02"))
+			if apologized[key] || missedAgain(day, r.Reminder, nextCall, location, now) {
+				message, outcome = "", outcomeSkipped
+			}
+			apologized[key] = true
+		}
+		if outcome != "" {
+			log.Println("reminder ", r.ID, " for alert ", r.ScheduleID, " was due at ", dueAt, ", outcome: ", outcome)
+			err = env.Store.RecordLateReminder(lateReminder{ReminderID: r.ID, ScheduleID: r.ScheduleID, PhoneNumber: r.PhoneNumber, DueAt: r.NextCall, HandledAt: now.Unix(), Outcome: outcome})
+			if err != nil {
+				log.Println("error recording late reminder: err", err)
+			}
+		}
+		if message == "" {
+			continue
+		}
+		env.remind(r, message)
+	}
 }
 
-func remind(phoneNumber string, sender smsMessager, id int) {
-	fmt.Println("sending message to: ", id)
-	message := "Don't forget about street sweeping tomorrow! (to stop getting these reminders, go to dontfearthesweeper.com/remove or email ouidevelop@gmail.com)"
-	err := sender.Send(from, phoneNumber, message)
+// remind texts message to the owner of reminder r, and records it in the delivery log whether it went out or not.
+func (env *Env) remind(r storedReminder, message string) {
+	fmt.Println("sending message to: ", r.ScheduleID)
+	m := sentMessage{
+		PhoneNumber: r.PhoneNumber,
+		ScheduleID:  r.ScheduleID,
+		ReminderID:  r.ID,
+		Body:        message,
+		Status:      messageSent,
+		DueAt:       r.NextCall,
+		SentAt:      Now().Unix(),
+	}
+	providerID, err := env.MsgSvc.Send(from, r.PhoneNumber, message)
 	if err != nil {
 		log.Println("problem sending message: ", err)
+		m.Status = messageFailed
+		if _, ok := err.(undeliverableError); ok {
+			m.Status = messageUndeliverable
+		}
+	}
+	m.ProviderID = providerID
+
+	err = env.Store.RecordMessage(m)
+	if err != nil {
+		log.Println("problem recording message: ", err)
 	}
 }
@@ -3,7 +3,13 @@ package main_test
 import (
 	. "github.com/ouidevelop/dontfearthesweeper"
 
+	"encoding/json"
+	"encoding/xml"
 	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 
 	"bytes"
@@ -17,35 +23,480 @@ import (
 var _ = Describe("Main", func() {
 	Describe("application", func() {
 		It("should alert people who's alert is past due", func() {
-			err := DB.Ping()
-			Expect(err).NotTo(HaveOccurred())
+			env := Env{MsgSvc: &MockMessageService{}, Store: NewMemoryStore()}
 
 			jsonAlert := []byte(`{"timezone":"America/New_York","times":[{"weekday":0,"nthWeek":1}],"phoneNumber":"1234567890","token":""}`)
 
-			clearDB()
-			defer clearDB()
-
 			req := httptest.NewRequest("POST", "/verification/verify", bytes.NewReader(jsonAlert))
 			res := httptest.NewRecorder()
-			MockEnv.VerificationVerifyHandler(res, req)
+			env.VerificationVerifyHandler(res, req)
 			Expect(res.Code).To(Equal(http.StatusOK))
 
-			var nextCall int64
-			err = DB.QueryRow("select NEXT_CALL from alerts").Scan(&nextCall)
+			consents, err := env.Store.Consents("1234567890")
 			Expect(err).NotTo(HaveOccurred())
-			Expect(nextCall).To(Equal(int64(1494111600))) //2017-05-06 19:00:00 -0400 EDT
+			Expect(consents).To(HaveLen(1))
+			Expect(consents[0].Kind).To(Equal("opt_in"))
+			Expect(consents[0].Source).To(Equal("web"))
+			Expect(consents[0].IPHash).NotTo(BeEmpty())
+
+			// 1 second before the next call of the alert, 2017-05-06 19:00:00 -0400 EDT
+			done := MockNow(time.Unix(1494111599, 0))
+			env.FindReadyAlerts()
+			done()
+			Expect(env.MsgSvc).To(Equal(&MockMessageService{}))
 
 			// 1 second after the next call of the alert
-			done := MockNow(time.Unix(1494111601, 0))
+			done = MockNow(time.Unix(1494111601, 0))
 			defer done()
 
-			FindReadyAlerts(MockEnv.MsgSvc)
+			env.FindReadyAlerts()
 			expected := &MockMessageService{
-				from: "5102414070",
+				from: os.Getenv("TWILIO_PHONE_NUMBER"),
 				to:   "1234567890",
-				body: "Don't forget about street sweeping tomorrow! (to stop getting these reminders, please email mjkurrels@gmail.com)",
+				body: "Don't forget about street sweeping tomorrow! (to stop getting these reminders, go to dontfearthesweeper.com/remove or email ouidevelop@gmail.com)",
+			}
+			Expect(env.MsgSvc).To(Equal(expected))
+
+			messages, err := env.Store.Messages("1234567890", 0, 10)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0].Body).To(Equal(expected.body))
+			Expect(messages[0].ProviderID).To(Equal("SM1234567890"))
+			Expect(messages[0].Status).To(Equal("sent"))
+			Expect(messages[0].DueAt).To(Equal(int64(1494111600)))
+			Expect(messages[0].SentAt).To(Equal(int64(1494111601)))
+		})
+	})
+
+	Describe("VerificationVerifyHandler", func() {
+		It("should reject days that can't be scheduled", func() {
+			jsonAlert := []byte(`{"timezone":"America/New_York","times":[{"weekday":0,"nthWeek":6}],"phoneNumber":"1234567890","token":""}`)
+
+			req := httptest.NewRequest("POST", "/verification/verify", bytes.NewReader(jsonAlert))
+			res := httptest.NewRecorder()
+			MockEnv.VerificationVerifyHandler(res, req)
+			Expect(res.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should reject rrules it can't schedule", func() {
+			jsonAlert := []byte(`{"timezone":"America/New_York","times":[{"kind":"rrule","rrule":"FREQ=DAILY;BYHOUR=8"}],"phoneNumber":"1234567890","token":""}`)
+
+			req := httptest.NewRequest("POST", "/verification/verify", bytes.NewReader(jsonAlert))
+			res := httptest.NewRecorder()
+			MockEnv.VerificationVerifyHandler(res, req)
+			Expect(res.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should reject seasons that aren't real dates", func() {
+			jsonAlert := []byte(`{"timezone":"America/New_York","times":[{"weekday":2,"nthWeek":1}],"season":{"start":"04-01","end":"11-31"},"phoneNumber":"1234567890","token":""}`)
+
+			req := httptest.NewRequest("POST", "/verification/verify", bytes.NewReader(jsonAlert))
+			res := httptest.NewRecorder()
+			MockEnv.VerificationVerifyHandler(res, req)
+			Expect(res.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should reject sweeping windows that end before they start", func() {
+			jsonAlert := []byte(`{"timezone":"America/New_York","times":[{"weekday":2,"nthWeek":1,"start":"10:00","end":"08:00"}],"phoneNumber":"1234567890","token":""}`)
+
+			req := httptest.NewRequest("POST", "/verification/verify", bytes.NewReader(jsonAlert))
+			res := httptest.NewRecorder()
+			MockEnv.VerificationVerifyHandler(res, req)
+			Expect(res.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should reject sweeping windows that overlap on the same day", func() {
+			// every tuesday includes the first tuesday
+			jsonAlert := []byte(`{"timezone":"America/New_York","times":[{"kind":"weekly","weekday":2,"start":"08:00","end":"10:00"},{"weekday":2,"nthWeek":1,"start":"09:00","end":"11:00"}],"phoneNumber":"1234567890","token":""}`)
+
+			req := httptest.NewRequest("POST", "/verification/verify", bytes.NewReader(jsonAlert))
+			res := httptest.NewRecorder()
+			MockEnv.VerificationVerifyHandler(res, req)
+			Expect(res.Code).To(Equal(http.StatusBadRequest))
+			Expect(res.Body.String()).To(ContainSubstring("overlaps"))
+		})
+
+		It("should reject rrule sweeping windows that overlap with another schedule", func() {
+			// every other tuesday since 2015 overlaps every tuesday
+			jsonAlert := []byte(`{"timezone":"America/New_York","times":[{"kind":"rrule","rrule":"FREQ=WEEKLY;INTERVAL=2;BYDAY=TU","anchor":"2015-01-06","start":"08:00","end":"10:00"},{"kind":"weekly","weekday":2,"start":"09:00","end":"11:00"}],"phoneNumber":"1234567890","token":""}`)
+
+			req := httptest.NewRequest("POST", "/verification/verify", bytes.NewReader(jsonAlert))
+			res := httptest.NewRecorder()
+			MockEnv.VerificationVerifyHandler(res, req)
+			Expect(res.Code).To(Equal(http.StatusBadRequest))
+			Expect(res.Body.String()).To(ContainSubstring("overlaps"))
+		})
+
+		It("should need to know which side someone is parked on if their schedules have sides", func() {
+			jsonAlert := []byte(`{"timezone":"America/New_York","times":[{"weekday":2,"nthWeek":1,"side":"odd"},{"weekday":4,"nthWeek":1,"side":"even"}],"phoneNumber":"1234567890","token":""}`)
+
+			req := httptest.NewRequest("POST", "/verification/verify", bytes.NewReader(jsonAlert))
+			res := httptest.NewRecorder()
+			MockEnv.VerificationVerifyHandler(res, req)
+			Expect(res.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should reject biweekly schedules whose anchor isn't on their weekday", func() {
+			jsonAlert := []byte(`{"timezone":"America/New_York","times":[{"kind":"biweekly","weekday":2,"anchor":"2017-07-20"}],"phoneNumber":"1234567890","token":""}`)
+
+			req := httptest.NewRequest("POST", "/verification/verify", bytes.NewReader(jsonAlert))
+			res := httptest.NewRecorder()
+			MockEnv.VerificationVerifyHandler(res, req)
+			Expect(res.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should say which times were already saved when someone signs up again", func() {
+			env := Env{MsgSvc: &MockMessageService{}, Store: NewMemoryStore()}
+			signUp := func(jsonAlert string) []int {
+				req := httptest.NewRequest("POST", "/verification/verify", bytes.NewReader([]byte(jsonAlert)))
+				res := httptest.NewRecorder()
+				env.VerificationVerifyHandler(res, req)
+				Expect(res.Code).To(Equal(http.StatusOK))
+
+				var result struct {
+					AlreadySaved []int `json:"alreadySaved"`
+				}
+				Expect(json.Unmarshal(res.Body.Bytes(), &result)).To(Succeed())
+				return result.AlreadySaved
+			}
+
+			Expect(signUp(`{"timezone":"America/New_York","times":[{"weekday":0,"nthWeek":1}],"phoneNumber":"1234567890","token":""}`)).To(BeEmpty())
+			Expect(signUp(`{"timezone":"America/New_York","times":[{"weekday":3,"nthWeek":2},{"weekday":0,"nthWeek":1}],"phoneNumber":"1234567890","token":""}`)).To(Equal([]int{1}))
+		})
+
+		It("should not record an opt in for an alert it couldn't save", func() {
+			env := Env{MsgSvc: &MockMessageService{}, Store: FailingSaveStore{NewMemoryStore()}}
+			jsonAlert := []byte(`{"timezone":"America/New_York","times":[{"weekday":0,"nthWeek":1}],"phoneNumber":"1234567890","token":""}`)
+			req := httptest.NewRequest("POST", "/verification/verify", bytes.NewReader(jsonAlert))
+			res := httptest.NewRecorder()
+			env.VerificationVerifyHandler(res, req)
+			Expect(res.Code).To(Equal(http.StatusInternalServerError))
+
+			consents, err := env.Store.Consents("1234567890")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(consents).To(BeEmpty())
+		})
+	})
+
+	Describe("side of the street", func() {
+		var env Env
+
+		// odd side sweeping is the first tuesday, with its reminder at 2017-05-01 19:00:00 -0400 EDT, and even side
+		// sweeping is the first thursday, with its reminder at 2017-05-03 19:00:00 -0400 EDT
+		BeforeEach(func() {
+			env = Env{MsgSvc: &MockMessageService{}, Store: NewMemoryStore()}
+			jsonAlert := []byte(`{"timezone":"America/New_York","times":[{"weekday":2,"nthWeek":1,"side":"odd"},{"weekday":4,"nthWeek":1,"side":"even"}],"parkedSide":"even","phoneNumber":"1234567890","token":""}`)
+			req := httptest.NewRequest("POST", "/verification/verify", bytes.NewReader(jsonAlert))
+			res := httptest.NewRecorder()
+			env.VerificationVerifyHandler(res, req)
+			Expect(res.Code).To(Equal(http.StatusOK))
+		})
+
+		text := func(body string) *httptest.ResponseRecorder {
+			form := url.Values{"From": {"+11234567890"}, "Body": {body}, "MessageSid": {"SM123"}}
+			req := httptest.NewRequest("POST", "/sms/incoming", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			res := httptest.NewRecorder()
+			env.IncomingSMSHandler(res, req)
+			return res
+		}
+
+		// replyTo texts body and returns what we text back
+		replyTo := func(body string) string {
+			res := text(body)
+			Expect(res.Code).To(Equal(http.StatusOK))
+			var reply struct {
+				Message string `xml:"Message"`
+			}
+			Expect(xml.Unmarshal(res.Body.Bytes(), &reply)).To(Succeed())
+			return reply.Message
+		}
+
+		parkedSide := func() string {
+			side, err := env.Store.ParkedSide("1234567890")
+			Expect(err).NotTo(HaveOccurred())
+			return side
+		}
+
+		It("should park people on the side they text", func() {
+			Expect(replyTo("ODD")).To(ContainSubstring("you're parked on the odd side"))
+			Expect(parkedSide()).To(Equal("odd"))
+
+			Expect(replyTo(" even ")).To(ContainSubstring("you're parked on the even side"))
+			Expect(parkedSide()).To(Equal("even"))
+		})
+
+		It("should flip sides when people text SWITCH", func() {
+			Expect(replyTo("SWITCH")).To(ContainSubstring("you're parked on the odd side"))
+			Expect(parkedSide()).To(Equal("odd"))
+			Expect(replyTo("switch")).To(ContainSubstring("you're parked on the even side"))
+			Expect(parkedSide()).To(Equal("even"))
+		})
+
+		It("should say what to text when it doesn't understand", func() {
+			Expect(replyTo("left")).To(ContainSubstring("Text ODD or EVEN"))
+			Expect(parkedSide()).To(Equal("even"))
+		})
+
+		It("should remove everything and record an opt out when people text STOP", func() {
+			Expect(replyTo("STOP")).To(ContainSubstring("You won't get any more street sweeping reminders"))
+
+			schedules, err := env.Store.Schedules("1234567890")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedules).To(BeEmpty())
+
+			consents, err := env.Store.Consents("1234567890")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(consents).To(HaveLen(2))
+			Expect(consents[1].Kind).To(Equal("opt_out"))
+			Expect(consents[1].Source).To(Equal("sms"))
+			Expect(consents[1].RequestID).To(Equal("SM123"))
+		})
+
+		It("should ignore texts that aren't signed by twilio", func() {
+			env.MsgSvc = &MockMessageService{badSignature: true}
+			Expect(text("ODD").Code).To(Equal(http.StatusForbidden))
+			Expect(text("STOP").Code).To(Equal(http.StatusForbidden))
+			Expect(parkedSide()).To(Equal("even"))
+
+			schedules, err := env.Store.Schedules("1234567890")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedules).To(HaveLen(2))
+		})
+
+		It("should only change the parked side on the website for people with side schedules", func() {
+			setSide := func(phoneNumber string) int {
+				jsonSide := []byte(`{"phoneNumber":"` + phoneNumber + `","token":"","side":"odd"}`)
+				req := httptest.NewRequest("POST", "/alerts/side", bytes.NewReader(jsonSide))
+				res := httptest.NewRecorder()
+				env.ParkedSideHandler(res, req)
+				return res.Code
+			}
+
+			Expect(setSide("1234567890")).To(Equal(http.StatusOK))
+			Expect(parkedSide()).To(Equal("odd"))
+
+			Expect(setSide("5555555555")).To(Equal(http.StatusBadRequest))
+			side, err := env.Store.ParkedSide("5555555555")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(side).To(BeEmpty())
+		})
+
+		It("should only remind people about the side they're parked on", func() {
+			// 1 second after the odd side reminder
+			done := MockNow(time.Unix(1493679601, 0))
+			env.FindReadyAlerts()
+			done()
+			Expect(env.MsgSvc).To(Equal(&MockMessageService{}))
+
+			// 1 second after the even side reminder
+			done = MockNow(time.Unix(1493852401, 0))
+			defer done()
+			env.FindReadyAlerts()
+			Expect(env.MsgSvc.(*MockMessageService).to).To(Equal("1234567890"))
+			Expect(env.MsgSvc.(*MockMessageService).body).To(ContainSubstring("tomorrow"))
+
+			messages, err := env.Store.Messages("1234567890", 0, 10)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(messages).To(HaveLen(1))
+			Expect(messages[0].DueAt).To(Equal(int64(1493852400)))
+		})
+	})
+
+	Describe("admin alerts", func() {
+		var env Env
+
+		BeforeEach(func() {
+			env = Env{MsgSvc: &MockMessageService{}, Store: NewMemoryStore(), AdminToken: "secret"}
+			jsonAlert := []byte(`{"timezone":"America/New_York","times":[{"weekday":0,"nthWeek":1}],"phoneNumber":"1234567890","token":""}`)
+			req := httptest.NewRequest("POST", "/verification/verify", bytes.NewReader(jsonAlert))
+			res := httptest.NewRecorder()
+			env.VerificationVerifyHandler(res, req)
+			Expect(res.Code).To(Equal(http.StatusOK))
+		})
+
+		post := func(path string) int {
+			req := httptest.NewRequest("POST", path, bytes.NewReader([]byte(`{"phoneNumber":"1234567890"}`)))
+			req.Header.Set("Authorization", "Bearer secret")
+			res := httptest.NewRecorder()
+			env.AdminAlertsHandler(res, req)
+			return res.Code
+		}
+
+		consentKinds := func() []string {
+			consents, err := env.Store.Consents("1234567890")
+			Expect(err).NotTo(HaveOccurred())
+			var kinds []string
+			for _, c := range consents {
+				kinds = append(kinds, c.Kind+" "+c.Source)
+			}
+			return kinds
+		}
+
+		It("should record an opt out when an admin removes all of someone's alerts", func() {
+			Expect(post("/admin/alerts/remove")).To(Equal(http.StatusOK))
+			Expect(consentKinds()).To(Equal([]string{"opt_in web", "opt_out admin"}))
+		})
+
+		It("should not restore alerts for someone who opted out until they opt in again", func() {
+			Expect(post("/admin/alerts/remove")).To(Equal(http.StatusOK))
+			Expect(post("/admin/alerts/restore")).To(Equal(http.StatusConflict))
+			schedules, err := env.Store.Schedules("1234567890")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedules).To(BeEmpty())
+
+			jsonAlert := []byte(`{"timezone":"America/New_York","times":[{"weekday":3,"nthWeek":2}],"phoneNumber":"1234567890","token":""}`)
+			req := httptest.NewRequest("POST", "/verification/verify", bytes.NewReader(jsonAlert))
+			res := httptest.NewRecorder()
+			env.VerificationVerifyHandler(res, req)
+			Expect(res.Code).To(Equal(http.StatusOK))
+
+			Expect(post("/admin/alerts/restore")).To(Equal(http.StatusOK))
+			schedules, err = env.Store.Schedules("1234567890")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedules).To(HaveLen(2))
+		})
+	})
+
+	Describe("catching up on late reminders", func() {
+		var env Env
+
+		// sweeping is the first sunday, 2017-05-07, with its reminder at 2017-05-06 19:00:00 -0400 EDT
+		const due = 1494111600
+		tomorrow := "Don't forget about street sweeping tomorrow! (to stop getting these reminders, go to dontfearthesweeper.com/remove or email ouidevelop@gmail.com)"
+		signUp := func(jsonAlert string) {
+			env = Env{MsgSvc: &MockMessageService{}, Store: NewMemoryStore()}
+			req := httptest.NewRequest("POST", "/verification/verify", bytes.NewReader([]byte(jsonAlert)))
+			res := httptest.NewRecorder()
+			env.VerificationVerifyHandler(res, req)
+			Expect(res.Code).To(Equal(http.StatusOK))
+		}
+		BeforeEach(func() {
+			signUp(`{"timezone":"America/New_York","times":[{"weekday":0,"nthWeek":1}],"phoneNumber":"1234567890","token":""}`)
+		})
+
+		// findAt runs FindReadyAlerts with policy at unix time now, and returns the texts sent and the late reminder
+		// outcomes recorded so far
+		findAt := func(policy string, now int64) ([]string, []string) {
+			defer MockCatchUpPolicy(policy)()
+			defer MockNow(time.Unix(now, 0))()
+			env.FindReadyAlerts()
+
+			messages, err := env.Store.Messages("1234567890", 0, 10)
+			Expect(err).NotTo(HaveOccurred())
+			var bodies []string
+			for i := len(messages) - 1; i >= 0; i-- {
+				bodies = append(bodies, messages[i].Body)
+			}
+			late, err := env.Store.LateReminders(time.Unix(0, 0), time.Unix(now+1, 0))
+			Expect(err).NotTo(HaveOccurred())
+			var outcomes []string
+			for _, l := range late {
+				Expect(l.PhoneNumber).To(Equal("1234567890"))
+				outcomes = append(outcomes, l.Outcome)
+			}
+			return bodies, outcomes
+		}
+
+		It("should send reminders that are a little late as usual, whatever the policy", func() {
+			for _, policy := range []string{"send", "skip", "apologize"} {
+				signUp(`{"timezone":"America/New_York","times":[{"weekday":0,"nthWeek":1}],"phoneNumber":"1234567890","token":""}`)
+				bodies, outcomes := findAt(policy, due+10*60)
+				Expect(bodies).To(Equal([]string{tomorrow}))
+				Expect(outcomes).To(BeEmpty())
+			}
+		})
+
+		It("should send late reminders before sweeping starts with the send policy", func() {
+			bodies, outcomes := findAt("send", due+60*60)
+			Expect(bodies).To(Equal([]string{tomorrow}))
+			Expect(outcomes).To(Equal([]string{"sent_late"}))
+		})
+
+		It("should skip late reminders after sweeping starts with the send policy", func() {
+			// 2017-05-07 10:00:00 -0400 EDT
+			bodies, outcomes := findAt("send", due+15*60*60)
+			Expect(bodies).To(BeEmpty())
+			Expect(outcomes).To(Equal([]string{"skipped"}))
+		})
+
+		It("should skip late reminders with the skip policy", func() {
+			bodies, outcomes := findAt("skip", due+60*60)
+			Expect(bodies).To(BeEmpty())
+			Expect(outcomes).To(Equal([]string{"skipped"}))
+		})
+
+		It("should apologize for missed sweeping days with the apologize policy", func() {
+			bodies, outcomes := findAt("apologize", due+60*60)
+			Expect(bodies).To(Equal([]string{tomorrow}))
+			Expect(outcomes).To(Equal([]string{"sent_late"}))
+
+			signUp(`{"timezone":"America/New_York","times":[{"weekday":0,"nthWeek":1}],"phoneNumber":"1234567890","token":""}`)
+			bodies, outcomes = findAt("apologize", due+15*60*60)
+			Expect(bodies).To(HaveLen(1))
+			Expect(bodies[0]).To(HavePrefix("Sorry! We missed your reminder about street sweeping on Sunday, May 7."))
+			Expect(outcomes).To(Equal([]string{"apologized"}))
+		})
+
+		It("should apologize once for a sweeping day however many of its reminders were missed", func() {
+			signUp(`{"timezone":"America/New_York","times":[{"weekday":0,"nthWeek":1}],"reminders":[{"daysBefore":1,"time":"19:00"},{"daysBefore":0,"time":"07:00"}],"phoneNumber":"1234567890","token":""}`)
+			bodies, outcomes := findAt("apologize", due+15*60*60)
+			Expect(bodies).To(HaveLen(1))
+			Expect(bodies[0]).To(HavePrefix("Sorry! We missed your reminder about street sweeping on Sunday, May 7."))
+			Expect(outcomes).To(Equal([]string{"apologized", "skipped"}))
+		})
+
+		It("should only apologize for the last of several missed sweeping days", func() {
+			// 2017-06-04 10:00:00 -0400 EDT, the first sunday of june
+			june := int64(1496584800)
+			bodies, outcomes := findAt("apologize", june)
+			Expect(bodies).To(BeEmpty())
+			Expect(outcomes).To(Equal([]string{"skipped"}))
+
+			bodies, outcomes = findAt("apologize", june+10)
+			Expect(bodies).To(HaveLen(1))
+			Expect(bodies[0]).To(HavePrefix("Sorry! We missed your reminder about street sweeping on Sunday, Jun 4."))
+			Expect(outcomes).To(Equal([]string{"skipped", "apologized"}))
+		})
+	})
+
+	Describe("PreviewHandler", func() {
+		It("should list the next sweeping days and reminders without saving anything", func() {
+			location, err := time.LoadLocation("America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			done := MockNow(time.Date(2017, 7, 31, 19, 1, 1, 0, location))
+			defer done()
+
+			jsonAlert := []byte(`{"timezone":"America/Los_Angeles","times":[{"weekday":2,"nthWeek":1}],"phoneNumber":"1234567890"}`)
+			req := httptest.NewRequest("POST", "/alerts/preview?count=3", bytes.NewReader(jsonAlert))
+			res := httptest.NewRecorder()
+			MockEnv.PreviewHandler(res, req)
+			Expect(res.Code).To(Equal(http.StatusOK))
+
+			var preview struct {
+				Times []struct {
+					Occurrences []struct {
+						Day       string      `json:"day"`
+						Reminders []time.Time `json:"reminders"`
+					} `json:"occurrences"`
+				} `json:"times"`
 			}
-			Expect(MockEnv.MsgSvc).To(Equal(expected))
+			Expect(json.Unmarshal(res.Body.Bytes(), &preview)).To(Succeed())
+			Expect(preview.Times).To(HaveLen(1))
+			occurrences := preview.Times[0].Occurrences
+			Expect(occurrences).To(HaveLen(3))
+			Expect(occurrences[0].Day).To(Equal("2017-09-05"))
+			Expect(occurrences[0].Reminders[0].Unix()).To(Equal(int64(1504576800))) //2017-09-04 19:00:00 -0700
+			Expect(occurrences[1].Day).To(Equal("2017-10-03"))
+			Expect(occurrences[2].Day).To(Equal("2017-11-07"))
+		})
+
+		It("should reject alerts that can't be scheduled", func() {
+			jsonAlert := []byte(`{"timezone":"Not/A_Timezone","times":[{"weekday":2,"nthWeek":1}]}`)
+			req := httptest.NewRequest("POST", "/alerts/preview", bytes.NewReader(jsonAlert))
+			res := httptest.NewRecorder()
+			MockEnv.PreviewHandler(res, req)
+			Expect(res.Code).To(Equal(http.StatusBadRequest))
 		})
 	})
 
@@ -57,27 +508,233 @@ var _ = Describe("Main", func() {
 			}
 			Expect(err).NotTo(HaveOccurred())
 
-			weekday := 2
-			nthWeek := 1
+			day := Day{Weekday: 2, NthWeek: 1}
 			timezone := "America/Los_Angeles"
 
 			fmt.Println("hi:", Now())
-			nextAlertTime, err := CalculateNextCall(nthWeek, weekday, timezone)
+			nextAlertTime, err := CalculateNextCall(day, timezone)
 			Expect(err).NotTo(HaveOccurred())
 			Expect(nextAlertTime).To(Equal(int64(1504576800))) //2017-09-04 19:00:00 -0700
 
 			// change the weekday to friday to make sure that the function determines that the next alert is this month
-			weekday = 5
+			day.Weekday = 5
 
-			nextAlertTime, err = CalculateNextCall(nthWeek, weekday, timezone)
+			nextAlertTime, err = CalculateNextCall(day, timezone)
 			fmt.Println("time: ", time.Unix(nextAlertTime, 0).In(location))
 			Expect(err).NotTo(HaveOccurred())
 			Expect(nextAlertTime).To(Equal(int64(1501812000))) //2017-08-03 19:00:00 -0700 PDT
 		})
+
+		It("should skip months that don't have a fifth weekday", func() {
+			location, err := time.LoadLocation("America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			done := MockNow(time.Date(2017, 7, 31, 19, 1, 1, 0, location))
+			defer done()
+
+			// august 2017 has a fifth tuesday
+			nextAlertTime, err := CalculateNextCall(Day{NthWeek: 5, Weekday: 2}, "America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1503972000))) //2017-08-28 19:00:00 -0700 PDT
+
+			// but not a fifth friday, so it should be september
+			nextAlertTime, err = CalculateNextCall(Day{NthWeek: 5, Weekday: 5}, "America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1506650400))) //2017-09-28 19:00:00 -0700 PDT
+		})
+
+		It("should calculate the last weekday of the month", func() {
+			location, err := time.LoadLocation("America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			done := MockNow(time.Date(2017, 7, 31, 19, 1, 1, 0, location))
+			defer done()
+
+			nextAlertTime, err := CalculateNextCall(Day{NthWeek: -1, Weekday: 5}, "America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1503626400))) //2017-08-24 19:00:00 -0700 PDT
+		})
+
+		It("should calculate weekly schedules", func() {
+			location, err := time.LoadLocation("America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			done := MockNow(time.Date(2017, 7, 31, 19, 1, 1, 0, location))
+			defer done()
+
+			// tonight's reminder for tuesday has already gone out
+			nextAlertTime, err := CalculateNextCall(Day{Kind: "weekly", Weekday: 2}, "America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1502157600))) //2017-08-07 19:00:00 -0700 PDT
+
+			nextAlertTime, err = CalculateNextCall(Day{Kind: "weekly", Weekday: 3}, "America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1501639200))) //2017-08-01 19:00:00 -0700 PDT
+		})
+
+		It("should calculate biweekly schedules from their anchor date", func() {
+			location, err := time.LoadLocation("America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			done := MockNow(time.Date(2017, 7, 31, 19, 1, 1, 0, location))
+			defer done()
+
+			nextAlertTime, err := CalculateNextCall(Day{Kind: "biweekly", Weekday: 4, Anchor: "2017-07-20"}, "America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1501725600))) //2017-08-02 19:00:00 -0700 PDT
+
+			nextAlertTime, err = CalculateNextCall(Day{Kind: "biweekly", Weekday: 4, Anchor: "2017-07-27"}, "America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1502330400))) //2017-08-09 19:00:00 -0700 PDT
+		})
+
+		It("should expand rrule schedules in the alert's timezone", func() {
+			location, err := time.LoadLocation("America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			done := MockNow(time.Date(2017, 7, 31, 19, 1, 1, 0, location))
+			defer done()
+
+			day := Day{Kind: "rrule", RRule: "FREQ=MONTHLY;BYDAY=1TU,3TU;BYMONTH=4,5,6,7,8,9,10"}
+			nextAlertTime, err := CalculateNextCall(day, "America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1502762400))) //2017-08-14 19:00:00 -0700 PDT
+
+			// the last weekday of the month
+			nextAlertTime, err = CalculateNextCall(Day{Kind: "rrule", RRule: "FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1"}, "America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1504144800))) //2017-08-30 19:00:00 -0700 PDT
+
+			// nothing in the winter, so after october it should be the first tuesday in april
+			done2 := MockNow(time.Date(2017, 10, 20, 0, 0, 0, 0, location))
+			defer done2()
+			nextAlertTime, err = CalculateNextCall(day, "America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1522720800))) //2018-04-02 19:00:00 -0700 PDT
+		})
+
+		It("should send reminders at the alert's lead time and send time", func() {
+			location, err := time.LoadLocation("America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			done := MockNow(time.Date(2017, 7, 31, 19, 1, 1, 0, location))
+			defer done()
+
+			day := Day{Weekday: 2, NthWeek: 1, Reminders: []Reminder{{DaysBefore: 0, Time: "06:30"}}}
+			nextAlertTime, err := CalculateNextCall(day, "America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1501594200))) //2017-08-01 06:30:00 -0700 PDT
+
+			// two days ahead of august 1st has already passed
+			day.Reminders = []Reminder{{DaysBefore: 2, Time: "19:00"}}
+			nextAlertTime, err = CalculateNextCall(day, "America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1504490400))) //2017-09-03 19:00:00 -0700 PDT
+		})
+
+		It("should use the soonest of several reminders", func() {
+			location, err := time.LoadLocation("America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			done := MockNow(time.Date(2017, 7, 31, 19, 1, 1, 0, location))
+			defer done()
+
+			// the night before reminder for august 1st just went out, but the morning of one hasn't
+			day := Day{Weekday: 2, NthWeek: 1, Reminders: []Reminder{{DaysBefore: 1, Time: "19:00"}, {DaysBefore: 0, Time: "06:30"}}}
+			nextAlertTime, err := CalculateNextCall(day, "America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1501594200))) //2017-08-01 06:30:00 -0700 PDT
+		})
+
+		It("should skip holidays in the timezone's holiday calendar", func() {
+			defer MockHolidayCalendars()()
+			file, err := ioutil.TempFile("", "holidays")
+			Expect(err).NotTo(HaveOccurred())
+			defer os.Remove(file.Name())
+			_, err = file.WriteString("America/Chicago:\n  federal: true\n")
+			Expect(err).NotTo(HaveOccurred())
+			file.Close()
+			Expect(LoadHolidayCalendars(file.Name())).To(Succeed())
+
+			location, err := time.LoadLocation("America/Chicago")
+			Expect(err).NotTo(HaveOccurred())
+			done := MockNow(time.Date(2017, 8, 28, 12, 0, 0, 0, location))
+			defer done()
+
+			// september 4th is labor day
+			day := Day{Kind: "weekly", Weekday: 1}
+			nextAlertTime, err := CalculateNextCall(day, "America/Chicago")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1505088000))) //2017-09-10 19:00:00 -0500 CDT
+
+			// the calendar can be changed without restarting
+			err = ioutil.WriteFile(file.Name(), []byte("America/Chicago:\n  federal: true\n  dates:\n    - 2017-09-11\n"), 0644)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(LoadHolidayCalendars(file.Name())).To(Succeed())
+			nextAlertTime, err = CalculateNextCall(day, "America/Chicago")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1505692800))) //2017-09-17 19:00:00 -0500 CDT
+		})
+
+		It("should skip sweeping days outside of the season", func() {
+			location, err := time.LoadLocation("America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			done := MockNow(time.Date(2017, 11, 28, 12, 0, 0, 0, location))
+			defer done()
+
+			day := Day{Kind: "weekly", Weekday: 2, Season: &Season{Start: "04-01", End: "11-30"}}
+			nextAlertTime, err := CalculateNextCall(day, "America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1522720800))) //2018-04-02 19:00:00 -0700 PDT
+		})
 	})
-})
 
-func clearDB() {
-	_, err := DB.Exec("Truncate table alerts")
-	Expect(err).NotTo(HaveOccurred())
-}
+	Describe("NextCallAfter", func() {
+		It("should move on to the next sweeping day even if it is already past", func() {
+			location, err := time.LoadLocation("America/Los_Angeles")
+			Expect(err).NotTo(HaveOccurred())
+			// the scheduler was down for weeks, so several sweeping days have gone by since this reminder was due
+			done := MockNow(time.Date(2017, 11, 1, 12, 0, 0, 0, location))
+			defer done()
+
+			day := Day{Kind: "weekly", Weekday: 2}
+			nextAlertTime, err := NextCallAfter(day, Reminder{DaysBefore: 1, Time: "19:00"}, "America/Los_Angeles", 1504576800) //2017-09-04 19:00:00 -0700 PDT
+			Expect(err).NotTo(HaveOccurred())
+			Expect(nextAlertTime).To(Equal(int64(1505181600))) //2017-09-11 19:00:00 -0700 PDT
+		})
+
+		It("should not lose any sweeping days over years of daylight savings changes", func() {
+			location, err := time.LoadLocation("America/New_York")
+			Expect(err).NotTo(HaveOccurred())
+			done := MockNow(time.Date(2016, 12, 31, 12, 0, 0, 0, location))
+			defer done()
+
+			day := Day{Kind: "weekly", Weekday: 0}
+			reminder := Reminder{DaysBefore: 1, Time: "19:00"}
+			call, err := CalculateNextCall(day, "America/New_York")
+			Expect(err).NotTo(HaveOccurred())
+
+			for sunday := time.Date(2017, 1, 1, 0, 0, 0, 0, location); sunday.Year() < 2021; sunday = sunday.AddDate(0, 0, 7) {
+				Expect(time.Unix(call, 0).In(location)).To(Equal(time.Date(sunday.Year(), sunday.Month(), sunday.Day()-1, 19, 0, 0, 0, location)))
+				call, err = NextCallAfter(day, reminder, "America/New_York", call)
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+
+		It("should not lose a reminder whose send time is skipped by daylight savings", func() {
+			location, err := time.LoadLocation("America/New_York")
+			Expect(err).NotTo(HaveOccurred())
+			done := MockNow(time.Date(2016, 12, 31, 12, 0, 0, 0, location))
+			defer done()
+
+			// daylight savings starts at 2am on the second sunday in march, so 2:30am doesn't happen that day
+			reminder := Reminder{DaysBefore: 0, Time: "02:30"}
+			day := Day{NthWeek: 2, Weekday: 0, Reminders: []Reminder{reminder}}
+			call, err := CalculateNextCall(day, "America/New_York")
+			Expect(err).NotTo(HaveOccurred())
+
+			for month := time.Date(2017, 1, 1, 0, 0, 0, 0, location); month.Year() < 2021; month = month.AddDate(0, 1, 0) {
+				sent := time.Unix(call, 0).In(location)
+				Expect(sent.Year()).To(Equal(month.Year()))
+				Expect(sent.Month()).To(Equal(month.Month()))
+				Expect(sent.Weekday()).To(Equal(time.Sunday))
+				Expect((sent.Day()-1)/7 + 1).To(Equal(2))
+				call, err = NextCallAfter(day, reminder, "America/New_York", call)
+				Expect(err).NotTo(HaveOccurred())
+			}
+		})
+	})
+})
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore is an AlertStore that keeps everything in memory, for tests and for trying the app out without a
+// database. It is safe for concurrent use.
+type memoryStore struct {
+	mu        sync.Mutex
+	lastID    int
+	schedules []memorySchedule
+	reminders []storedReminder
+	// parked has the side each subscriber is parked on, by phone number
+	parked   map[string]string
+	late     []lateReminder
+	messages []sentMessage
+	consents []consentEvent
+}
+
+// memorySchedule is a saved schedule and whose it is.
+type memorySchedule struct {
+	phoneNumber string
+	storedSchedule
+}
+
+// NewMemoryStore returns an empty AlertStore that keeps everything in memory.
+func NewMemoryStore() AlertStore {
+	return &memoryStore{parked: map[string]string{}}
+}
+
+func (s *memoryStore) Save(a alert) ([]int, error) {
+	scheduled, err := scheduleDays(a)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var existing []int
+	for i, sd := range scheduled {
+		// keep the day the way the SQL stores give it back: without its reminders, and with its own season
+		day := sd.Day
+		day.Reminders = nil
+		if day.Season != nil {
+			season := *day.Season
+			day.Season = &season
+		}
+
+		sc := s.findSchedule(a.PhoneNumber, a.Timezone, day.key())
+		if sc != nil {
+			existing = append(existing, i)
+		} else {
+			s.lastID++
+			s.schedules = append(s.schedules, memorySchedule{
+				phoneNumber:    a.PhoneNumber,
+				storedSchedule: storedSchedule{ID: s.lastID, Timezone: a.Timezone, Day: day, NextCall: sd.NextCall},
+			})
+			sc = &s.schedules[len(s.schedules)-1]
+		}
+		for j, r := range sd.Day.reminders() {
+			if s.hasReminder(sc.ID, r) {
+				continue
+			}
+			s.lastID++
+			s.reminders = append(s.reminders, storedReminder{
+				ID:          s.lastID,
+				ScheduleID:  sc.ID,
+				PhoneNumber: a.PhoneNumber,
+				Timezone:    a.Timezone,
+				Day:         sc.Day,
+				Reminder:    r,
+				NextCall:    sd.NextCalls[j],
+			})
+			if sd.NextCalls[j] < sc.NextCall {
+				sc.NextCall = sd.NextCalls[j]
+			}
+		}
+	}
+	if a.ParkedSide != "" {
+		s.parked[a.PhoneNumber] = a.ParkedSide
+	}
+	return existing, nil
+}
+
+// findSchedule returns phoneNumber's schedule in timezone for the day with key dayKey that hasn't been removed, or
+// nil if they don't have one.
+func (s *memoryStore) findSchedule(phoneNumber, timezone, dayKey string) *memorySchedule {
+	for i, sc := range s.schedules {
+		if sc.phoneNumber == phoneNumber && sc.Timezone == timezone && sc.Day.key() == dayKey && sc.Removed == nil {
+			return &s.schedules[i]
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) hasReminder(scheduleID int, r Reminder) bool {
+	for _, stored := range s.reminders {
+		if stored.ScheduleID == scheduleID && stored.Reminder == r {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) Remove(phoneNumber string, why removal) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.schedules {
+		if s.schedules[i].phoneNumber == phoneNumber && s.schedules[i].Removed == nil {
+			removed := why
+			s.schedules[i].Removed = &removed
+		}
+	}
+	delete(s.parked, phoneNumber)
+	return nil
+}
+
+func (s *memoryStore) RemoveSchedule(phoneNumber string, scheduleID int, why removal) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sc := s.schedule(scheduleID)
+	if sc == nil || sc.phoneNumber != phoneNumber || sc.Removed != nil {
+		return false, nil
+	}
+	sc.Removed = &why
+	return true, nil
+}
+
+func (s *memoryStore) Restore(phoneNumber string, scheduleID int) ([]int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var removed []*memorySchedule
+	for i := range s.schedules {
+		sc := &s.schedules[i]
+		if sc.phoneNumber == phoneNumber && sc.Removed != nil && (scheduleID == 0 || sc.ID == scheduleID) {
+			removed = append(removed, sc)
+		}
+	}
+	// if a day was removed more than once, restore the latest
+	sort.SliceStable(removed, func(i, j int) bool { return removed[i].Removed.At > removed[j].Removed.At })
+
+	var restored []int
+	now := Now().Unix()
+	for _, sc := range removed {
+		if s.findSchedule(phoneNumber, sc.Timezone, sc.Day.key()) != nil {
+			continue
+		}
+		sc.NextCall = math.MaxInt64
+		for i := range s.reminders {
+			r := &s.reminders[i]
+			if r.ScheduleID != sc.ID {
+				continue
+			}
+			if r.NextCall <= now {
+				r.NextCall = restoredNextCall(r.Day, r.Reminder, r.Timezone)
+			}
+			if r.NextCall < sc.NextCall {
+				sc.NextCall = r.NextCall
+			}
+		}
+		sc.Removed = nil
+		restored = append(restored, sc.ID)
+	}
+	return restored, nil
+}
+
+func (s *memoryStore) PurgeRemoved(before int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []memorySchedule
+	purgedFrom := map[string]bool{}
+	for _, sc := range s.schedules {
+		if sc.Removed != nil && sc.Removed.At < before {
+			purgedFrom[sc.phoneNumber] = true
+			continue
+		}
+		kept = append(kept, sc)
+	}
+	for _, sc := range kept {
+		delete(purgedFrom, sc.phoneNumber)
+	}
+	purged := len(s.schedules) - len(kept)
+	s.schedules = kept
+	s.removeOrphanReminders()
+	for phoneNumber := range purgedFrom {
+		delete(s.parked, phoneNumber)
+	}
+	return purged, nil
+}
+
+func (s *memoryStore) Forget(phoneNumber string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var schedules []memorySchedule
+	for _, sc := range s.schedules {
+		if sc.phoneNumber != phoneNumber {
+			schedules = append(schedules, sc)
+		}
+	}
+	s.schedules = schedules
+	s.removeOrphanReminders()
+	delete(s.parked, phoneNumber)
+
+	var late []lateReminder
+	for _, l := range s.late {
+		if l.PhoneNumber != phoneNumber {
+			late = append(late, l)
+		}
+	}
+	s.late = late
+	var messages []sentMessage
+	for _, m := range s.messages {
+		if m.PhoneNumber != phoneNumber {
+			messages = append(messages, m)
+		}
+	}
+	s.messages = messages
+	return nil
+}
+
+// removeOrphanReminders removes the reminders whose schedule is gone, like the SQL stores' foreign keys do.
+func (s *memoryStore) removeOrphanReminders() {
+	var kept []storedReminder
+	for _, r := range s.reminders {
+		if s.schedule(r.ScheduleID) != nil {
+			kept = append(kept, r)
+		}
+	}
+	s.reminders = kept
+}
+
+// live reports whether the schedule with ID id is there and hasn't been removed.
+func (s *memoryStore) live(id int) bool {
+	sc := s.schedule(id)
+	return sc != nil && sc.Removed == nil
+}
+
+// schedule returns the schedule with ID id, or nil if there isn't one.
+func (s *memoryStore) schedule(id int) *memorySchedule {
+	for i := range s.schedules {
+		if s.schedules[i].ID == id {
+			return &s.schedules[i]
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Schedules(phoneNumber string) ([]storedSchedule, error) {
+	return s.schedulesOf(phoneNumber, false), nil
+}
+
+func (s *memoryStore) RemovedSchedules(phoneNumber string) ([]storedSchedule, error) {
+	return s.schedulesOf(phoneNumber, true), nil
+}
+
+// schedulesOf returns phoneNumber's removed schedules, or the ones that haven't been removed.
+func (s *memoryStore) schedulesOf(phoneNumber string, removed bool) []storedSchedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var schedules []storedSchedule
+	for _, sc := range s.schedules {
+		if sc.phoneNumber != phoneNumber || (sc.Removed != nil) != removed {
+			continue
+		}
+		schedule := sc.storedSchedule
+		if schedule.Removed != nil {
+			why := *schedule.Removed
+			schedule.Removed = &why
+		}
+		schedule.Day.Reminders = nil
+		for _, r := range s.reminders {
+			if r.ScheduleID == sc.ID {
+				schedule.Day.Reminders = append(schedule.Day.Reminders, r.Reminder)
+			}
+		}
+		schedules = append(schedules, schedule)
+	}
+	return schedules
+}
+
+func (s *memoryStore) DueReminders(now int64) ([]storedReminder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []storedReminder
+	for _, r := range s.reminders {
+		if r.NextCall < now && s.live(r.ScheduleID) {
+			r.ParkedSide = s.parked[r.PhoneNumber]
+			due = append(due, r)
+		}
+	}
+	return due, nil
+}
+
+func (s *memoryStore) Reminders(timezone string, scheduleID int) ([]storedReminder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var stored []storedReminder
+	for _, r := range s.reminders {
+		if (timezone == "" || r.Timezone == timezone) && (scheduleID == 0 || r.ScheduleID == scheduleID) && s.live(r.ScheduleID) {
+			stored = append(stored, r)
+		}
+	}
+	return stored, nil
+}
+
+func (s *memoryStore) UpdateNextCalls(changes []nextCallChange) ([]nextCallChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var skipped []nextCallChange
+	for _, c := range changes {
+		if c.New == c.Old {
+			continue
+		}
+		updated := false
+		for i := range s.reminders {
+			if s.reminders[i].ID == c.ReminderID && s.reminders[i].NextCall == c.Old {
+				s.reminders[i].NextCall = c.New
+				updated = true
+			}
+		}
+		if !updated {
+			skipped = append(skipped, c)
+			continue
+		}
+		if sc := s.schedule(c.ScheduleID); sc != nil {
+			sc.NextCall = math.MaxInt64
+			for _, r := range s.reminders {
+				if r.ScheduleID == sc.ID && r.NextCall < sc.NextCall {
+					sc.NextCall = r.NextCall
+				}
+			}
+		}
+	}
+	return skipped, nil
+}
+
+func (s *memoryStore) RecordLateReminder(l lateReminder) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.late = append(s.late, l)
+	return nil
+}
+
+func (s *memoryStore) LateReminders(since, until time.Time) ([]lateReminder, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var late []lateReminder
+	for _, l := range s.late {
+		if l.DueAt >= since.Unix() && l.DueAt < until.Unix() {
+			late = append(late, l)
+		}
+	}
+	sort.SliceStable(late, func(i, j int) bool { return late[i].DueAt < late[j].DueAt })
+	return late, nil
+}
+
+func (s *memoryStore) RecordMessage(m sentMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID++
+	m.ID = s.lastID
+	s.messages = append(s.messages, m)
+	return nil
+}
+
+func (s *memoryStore) Messages(phoneNumber string, before, limit int) ([]sentMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var messages []sentMessage
+	for i := len(s.messages) - 1; i >= 0 && len(messages) < limit; i-- {
+		m := s.messages[i]
+		if (phoneNumber == "" || m.PhoneNumber == phoneNumber) && (before == 0 || m.ID < before) {
+			messages = append(messages, m)
+		}
+	}
+	return messages, nil
+}
+
+func (s *memoryStore) PurgeMessages(before int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []sentMessage
+	for _, m := range s.messages {
+		if m.SentAt >= before {
+			kept = append(kept, m)
+		}
+	}
+	purged := len(s.messages) - len(kept)
+	s.messages = kept
+	return purged, nil
+}
+
+func (s *memoryStore) UndeliverableSubscribers(failures int) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	undeliverable := map[string]int{}
+	checked := map[string]bool{}
+	var phoneNumbers []string
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		m := s.messages[i]
+		if checked[m.PhoneNumber] || !s.live(m.ScheduleID) {
+			continue
+		}
+		if m.Status != messageUndeliverable {
+			checked[m.PhoneNumber] = true
+			continue
+		}
+		undeliverable[m.PhoneNumber]++
+		if undeliverable[m.PhoneNumber] == failures {
+			checked[m.PhoneNumber] = true
+			phoneNumbers = append(phoneNumbers, m.PhoneNumber)
+		}
+	}
+	sort.Strings(phoneNumbers)
+	return phoneNumbers, nil
+}
+
+func (s *memoryStore) RecordConsent(c consentEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastID++
+	c.ID = s.lastID
+	s.consents = append(s.consents, c)
+	return nil
+}
+
+func (s *memoryStore) Consents(phoneNumber string) ([]consentEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var consents []consentEvent
+	for _, c := range s.consents {
+		if phoneNumber == "" || c.PhoneNumber == phoneNumber {
+			consents = append(consents, c)
+		}
+	}
+	return consents, nil
+}
+
+func (s *memoryStore) SetParkedSide(phoneNumber, side string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parked[phoneNumber] = side
+	return nil
+}
+
+func (s *memoryStore) ParkedSide(phoneNumber string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.parked[phoneNumber], nil
+}
+
+func (s *memoryStore) HasSideSchedules(phoneNumber string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sc := range s.schedules {
+		if sc.phoneNumber == phoneNumber && sc.Removed == nil && sc.Day.Side != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
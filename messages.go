@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// The statuses a sent message is recorded with. messageSent means the message service took it, not that it
+// reached the phone. messageUndeliverable means the message service said it never will, because the phone number
+// doesn't exist or can't get texts, or has blocked ours.
+const (
+	messageSent          = "sent"
+	messageFailed        = "failed"
+	messageUndeliverable = "undeliverable"
+)
+
+// defaultHistoryLimit and maxHistoryLimit are how many messages a page of history has if the request doesn't say,
+// and at most.
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+// sentMessage is a reminder text we sent, or tried to, for the delivery log. ProviderID is the message service's
+// ID for it, and is empty if it couldn't be sent.
+type sentMessage struct {
+	ID          int    `json:"id"`
+	PhoneNumber string `json:"phoneNumber"`
+	ScheduleID  int    `json:"scheduleId"`
+	ReminderID  int    `json:"reminderId"`
+	Body        string `json:"body"`
+	ProviderID  string `json:"providerId"`
+	Status      string `json:"status"`
+	DueAt       int64  `json:"dueAt"`
+	SentAt      int64  `json:"sentAt"`
+}
+
+type messageHistoryRequest struct {
+	PhoneNumber string `json:"phoneNumber"`
+	Token       string `json:"token"`
+	Before      int    `json:"before"`
+	Limit       int    `json:"limit"`
+}
+
+// messageHistory is a page of the delivery log, newest first. Before is what to ask for the next page with, and is
+// 0 on the last page.
+type messageHistory struct {
+	Messages []sentMessage `json:"messages"`
+	Before   int           `json:"before"`
+}
+
+// historyLimit turns the page size a request asked for into one we are willing to give.
+func historyLimit(limit int) int {
+	if limit <= 0 {
+		return defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		return maxHistoryLimit
+	}
+	return limit
+}
+
+// writeMessageHistory writes the page of phoneNumber's messages, or everyone's if it is "", that come before the
+// message with ID before.
+func (env *Env) writeMessageHistory(w http.ResponseWriter, phoneNumber string, before, limit int) {
+	limit = historyLimit(limit)
+	messages, err := env.Store.Messages(phoneNumber, before, limit)
+	if err != nil {
+		log.Println("problem finding messages: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "oops! we made a mistake")
+		return
+	}
+
+	history := messageHistory{Messages: messages}
+	if history.Messages == nil {
+		history.Messages = []sentMessage{}
+	}
+	if len(messages) == limit {
+		history.Before = messages[len(messages)-1].ID
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// messageHistoryHandler gives someone the reminders we have texted them, once they have verified their phone
+// number.
+func (env *Env) messageHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var t messageHistoryRequest
+	err := decoder.Decode(&t)
+	if err != nil {
+		log.Println("error decoding json: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "oops! we made a mistake")
+		return
+	}
+	defer r.Body.Close()
+
+	verified, err := env.MsgSvc.VerifyCode(t.PhoneNumber, t.Token)
+	if err != nil || !verified {
+		log.Println("error verifying code: error: ", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, "validation code incorrect")
+		return
+	}
+
+	env.writeMessageHistory(w, t.PhoneNumber, t.Before, t.Limit)
+}
+
+// adminMessagesHandler lists the delivery log, for everyone or for the phoneNumber query parameter, a page at a
+// time with the before and limit query parameters.
+func (env *Env) adminMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if !env.isAdmin(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, "not authorized")
+		return
+	}
+
+	query := r.URL.Query()
+	var before, limit int
+	var err error
+	if s := query.Get("before"); s != "" {
+		before, err = strconv.Atoi(s)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "before must be a number")
+			return
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "limit must be a number")
+			return
+		}
+	}
+
+	env.writeMessageHistory(w, query.Get("phoneNumber"), before, limit)
+}
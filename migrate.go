@@ -0,0 +1,1150 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// migration is one versioned change to the database schema. up makes the change and down undoes it, in whichever
+// dialect the database speaks. MySQL commits any open transaction when it runs a CREATE, ALTER or DROP, so a
+// migration that fails part way through can leave some of its changes behind; each one is written so that running
+// it again finishes the job.
+type migration struct {
+	Version int
+	Name    string
+	up      func(tx *sql.Tx, d dialect) error
+	down    func(tx *sql.Tx, d dialect) error
+}
+
+// migrations are the changes to the schema, oldest first. Never change or reorder one that has been released; add a
+// new one to the end instead.
+var migrations = []migration{
+	{
+		// the schema as it was before there were migrations. Databases created back then have some or all of it,
+		// depending on which version of the app created them, so everything here has to be safe to run again.
+		Version: 1,
+		Name:    "baseline",
+		up: func(tx *sql.Tx, d dialect) error {
+			for _, s := range baselineSchema[d] {
+				_, err := tx.Exec(s)
+				if err != nil {
+					return err
+				}
+			}
+			err := addAlertsColumns(tx, d)
+			if err != nil {
+				return err
+			}
+
+			// alerts saved before there was a reminders table get the reminder they have always had: 7pm the night
+			// before, or the one they chose while alerts had a column for it.
+			hasLeadDays, err := columnExists(tx, d, "alerts", "LEAD_DAYS")
+			if err != nil {
+				return err
+			}
+			if hasLeadDays {
+				_, err = tx.Exec(`INSERT INTO reminders (ALERT_ID, LEAD_DAYS, SEND_TIME, NEXT_CALL)
+				  SELECT ID, LEAD_DAYS, SEND_TIME, NEXT_CALL FROM alerts WHERE ID NOT IN (SELECT ALERT_ID FROM reminders)`)
+				return err
+			}
+			_, err = tx.Exec(d.rebind(`INSERT INTO reminders (ALERT_ID, LEAD_DAYS, SEND_TIME, NEXT_CALL)
+				  SELECT ID, ?, ?, NEXT_CALL FROM alerts WHERE ID NOT IN (SELECT ALERT_ID FROM reminders)`),
+				defaultReminder.DaysBefore, defaultReminder.Time)
+			return err
+		},
+		down: func(tx *sql.Tx, d dialect) error {
+			for _, table := range []string{"late_reminders", "parked_sides", "reminders", "alerts"} {
+				_, err := tx.Exec("DROP TABLE IF EXISTS " + table)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// save has always set COUNTRY_CODE, but only databases from before the create statement lost it have the
+		// column.
+		Version: 2,
+		Name:    "alerts country code",
+		up: func(tx *sql.Tx, d dialect) error {
+			exists, err := columnExists(tx, d, "alerts", "COUNTRY_CODE")
+			if err != nil || exists {
+				return err
+			}
+			_, err = tx.Exec("ALTER TABLE alerts ADD COLUMN COUNTRY_CODE INT NOT NULL DEFAULT 1")
+			return err
+		},
+		down: func(tx *sql.Tx, d dialect) error {
+			_, err := tx.Exec("ALTER TABLE alerts DROP COLUMN COUNTRY_CODE")
+			return err
+		},
+	},
+	{
+		// split the flat alerts table, which repeated the phone number on every row, into subscribers and their
+		// schedules. Schedules keep the IDs their alerts had, so reminders and late reminders still point at them.
+		Version: 3,
+		Name:    "subscribers and schedules",
+		up:      normalizeAlerts,
+		down:    flattenSchedules,
+	},
+	{
+		// people who signed up twice got every schedule twice, and two of every text. Merge the copies, and make
+		// sure there can't be any more.
+		Version: 4,
+		Name:    "unique schedules",
+		up:      uniqueSchedules,
+		down: func(tx *sql.Tx, d dialect) error {
+			statements := []string{
+				dropUnique(d, "reminders", "reminders_time"),
+				dropUnique(d, "schedules", "schedules_day"),
+				"ALTER TABLE schedules DROP COLUMN DAY_KEY",
+			}
+			for _, s := range statements {
+				_, err := tx.Exec(s)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// the delivery log of every reminder text we send
+		Version: 5,
+		Name:    "messages",
+		up: func(tx *sql.Tx, d dialect) error {
+			for _, s := range messagesSchema[d] {
+				_, err := tx.Exec(s)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		down: func(tx *sql.Tx, d dialect) error {
+			_, err := tx.Exec("DROP TABLE IF EXISTS messages")
+			return err
+		},
+	},
+	{
+		// removing schedules marks them removed, with why, instead of deleting them. A subscriber can have any
+		// number of removed schedules for a day, so the unique key only covers the ones that haven't been: REMOVED_ID
+		// is 0 until a schedule is removed, and its own ID after.
+		Version: 6,
+		Name:    "soft delete schedules",
+		up:      softDeleteSchedules,
+		down: func(tx *sql.Tx, d dialect) error {
+			statements := []string{
+				"DELETE FROM schedules WHERE DELETED_AT <> 0",
+				"ALTER TABLE schedules ADD CONSTRAINT schedules_day UNIQUE (SUBSCRIBER_ID, TIMEZONE, DAY_KEY)",
+				dropUnique(d, "schedules", "schedules_live_day"),
+				"ALTER TABLE schedules DROP COLUMN DELETED_AT",
+				"ALTER TABLE schedules DROP COLUMN DELETE_REASON",
+				"ALTER TABLE schedules DROP COLUMN DELETE_REQUEST_ID",
+				"ALTER TABLE schedules DROP COLUMN REMOVED_ID",
+			}
+			for _, s := range statements {
+				_, err := tx.Exec(s)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// phone numbers are saved encrypted, and looked up by their blind index. See phoneNumberKeys.
+		Version: 7,
+		Name:    "encrypt phone numbers",
+		up:      encryptPhoneNumbers,
+		down:    decryptPhoneNumbers,
+	},
+	{
+		// the ledger of when and how people opted in to our texts and out of them
+		Version: 8,
+		Name:    "consents",
+		up: func(tx *sql.Tx, d dialect) error {
+			for _, s := range consentsSchema[d] {
+				_, err := tx.Exec(s)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		down: func(tx *sql.Tx, d dialect) error {
+			_, err := tx.Exec("DROP TABLE IF EXISTS consents")
+			return err
+		},
+	},
+}
+
+// consentsSchema is the consent ledger table added in migration 8.
+var consentsSchema = map[dialect][]string{
+	mysqlDialect: {
+		`CREATE TABLE IF NOT EXISTS consents(
+				   ID INT NOT NULL AUTO_INCREMENT,
+				   PHONE_INDEX VARCHAR(64) NOT NULL,
+				   ENCRYPTED_PHONE VARCHAR(255) NOT NULL,
+				   KIND VARCHAR(20) NOT NULL,
+				   SOURCE VARCHAR(20) NOT NULL,
+				   DISCLOSURE_VERSION VARCHAR(20) NOT NULL,
+				   IP_HASH VARCHAR(64) NOT NULL DEFAULT '',
+				   USER_AGENT_HASH VARCHAR(64) NOT NULL DEFAULT '',
+				   REQUEST_ID VARCHAR(100) NOT NULL DEFAULT '',
+				   RECORDED_AT BIGINT NOT NULL,
+				   PRIMARY KEY  (ID),
+				   INDEX consents_phone_index (PHONE_INDEX, ID)
+				)`,
+	},
+	postgresDialect: {
+		`CREATE TABLE IF NOT EXISTS consents(
+				   ID SERIAL,
+				   PHONE_INDEX VARCHAR(64) NOT NULL,
+				   ENCRYPTED_PHONE VARCHAR(255) NOT NULL,
+				   KIND VARCHAR(20) NOT NULL,
+				   SOURCE VARCHAR(20) NOT NULL,
+				   DISCLOSURE_VERSION VARCHAR(20) NOT NULL,
+				   IP_HASH VARCHAR(64) NOT NULL DEFAULT '',
+				   USER_AGENT_HASH VARCHAR(64) NOT NULL DEFAULT '',
+				   REQUEST_ID VARCHAR(100) NOT NULL DEFAULT '',
+				   RECORDED_AT BIGINT NOT NULL,
+				   PRIMARY KEY  (ID)
+				)`,
+		`CREATE INDEX IF NOT EXISTS consents_phone_index ON consents (PHONE_INDEX, ID)`,
+	},
+}
+
+// migration7Tables are the tables migration 7 encrypts the phone numbers of. Tables added since create their
+// ENCRYPTED_PHONE and PHONE_INDEX columns themselves, so this mustn't grow along with encryptedPhoneTables.
+var migration7Tables = []string{"subscribers", "late_reminders", "messages"}
+
+// encryptPhoneNumbers replaces the PHONE_NUMBER column of each of migration7Tables with ENCRYPTED_PHONE and
+// PHONE_INDEX, filled in with phoneKeys, and indexes the PHONE_INDEX of late_reminders and messages, which are
+// looked up by it.
+func encryptPhoneNumbers(tx *sql.Tx, d dialect) error {
+	for _, table := range migration7Tables {
+		columns := []struct{ name, definition string }{
+			{"ENCRYPTED_PHONE", "VARCHAR(255) NOT NULL DEFAULT ''"},
+			{"PHONE_INDEX", "VARCHAR(64) NOT NULL DEFAULT ''"},
+		}
+		for _, c := range columns {
+			exists, err := columnExists(tx, d, table, c.name)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + c.name + " " + c.definition)
+			if err != nil {
+				return err
+			}
+		}
+
+		// a run that failed part way through may have dropped PHONE_NUMBER already
+		exists, err := columnExists(tx, d, table, "PHONE_NUMBER")
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		phoneNumbers := map[int]string{}
+		rows, err := tx.Query("SELECT ID, PHONE_NUMBER FROM " + table + " WHERE PHONE_INDEX = ''")
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int
+			var phoneNumber string
+			err := rows.Scan(&id, &phoneNumber)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			phoneNumbers[id] = phoneNumber
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for id, phoneNumber := range phoneNumbers {
+			encrypted, index, err := encryptPhone(phoneNumber)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(d.rebind("UPDATE "+table+" SET ENCRYPTED_PHONE = ?, PHONE_INDEX = ? WHERE ID = ?"), encrypted, index, id)
+			if err != nil {
+				return err
+			}
+		}
+		// dropping the column drops the unique key and index it was in
+		_, err = tx.Exec("ALTER TABLE " + table + " DROP COLUMN PHONE_NUMBER")
+		if err != nil {
+			return err
+		}
+	}
+
+	exists, err := constraintExists(tx, d, "subscribers", "subscribers_phone_index")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = tx.Exec("ALTER TABLE subscribers ADD CONSTRAINT subscribers_phone_index UNIQUE (PHONE_INDEX)")
+		if err != nil {
+			return err
+		}
+	}
+	indexes := []struct{ table, name, columns string }{
+		{"late_reminders", "late_reminders_phone_index", "PHONE_INDEX"},
+		{"messages", "messages_phone_index", "PHONE_INDEX, ID"},
+	}
+	for _, i := range indexes {
+		exists, err = indexExists(tx, d, i.table, i.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		_, err = tx.Exec("CREATE INDEX " + i.name + " ON " + i.table + " (" + i.columns + ")")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decryptPhoneNumbers puts back the PHONE_NUMBER columns encryptPhoneNumbers replaced.
+func decryptPhoneNumbers(tx *sql.Tx, d dialect) error {
+	phoneType := "CHAR(10)"
+	if d == postgresDialect {
+		phoneType = "VARCHAR(10)"
+	}
+	for _, table := range migration7Tables {
+		exists, err := columnExists(tx, d, table, "PHONE_NUMBER")
+		if err != nil {
+			return err
+		}
+		if !exists {
+			_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN PHONE_NUMBER " + phoneType + " NOT NULL DEFAULT ''")
+			if err != nil {
+				return err
+			}
+		}
+
+		encrypted := map[int]string{}
+		rows, err := tx.Query("SELECT ID, ENCRYPTED_PHONE FROM " + table)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var id int
+			var e string
+			err := rows.Scan(&id, &e)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			encrypted[id] = e
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for id, e := range encrypted {
+			phoneNumber, err := decryptPhone(e)
+			if err != nil {
+				return fmt.Errorf("%s row %d: %v", table, id, err)
+			}
+			_, err = tx.Exec(d.rebind("UPDATE "+table+" SET PHONE_NUMBER = ? WHERE ID = ?"), phoneNumber, id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// late_reminders_phone_index goes when its only column is dropped, but MySQL would keep messages_phone_index
+	// on just ID
+	dropIndex := "DROP INDEX messages_phone_index ON messages"
+	if d == postgresDialect {
+		dropIndex = "DROP INDEX messages_phone_index"
+	}
+	statements := []string{
+		"ALTER TABLE subscribers ADD CONSTRAINT subscribers_phone_number_key UNIQUE (PHONE_NUMBER)",
+		"CREATE INDEX messages_phone_number ON messages (PHONE_NUMBER, ID)",
+		dropIndex,
+	}
+	for _, table := range migration7Tables {
+		statements = append(statements, "ALTER TABLE "+table+" DROP COLUMN ENCRYPTED_PHONE", "ALTER TABLE "+table+" DROP COLUMN PHONE_INDEX")
+	}
+	for _, s := range statements {
+		_, err := tx.Exec(s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func softDeleteSchedules(tx *sql.Tx, d dialect) error {
+	columns := []struct{ name, definition string }{
+		{"DELETED_AT", "BIGINT NOT NULL DEFAULT 0"},
+		{"DELETE_REASON", "VARCHAR(20) NOT NULL DEFAULT ''"},
+		{"DELETE_REQUEST_ID", "VARCHAR(100) NOT NULL DEFAULT ''"},
+		{"REMOVED_ID", "INT NOT NULL DEFAULT 0"},
+	}
+	for _, c := range columns {
+		exists, err := columnExists(tx, d, "schedules", c.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		_, err = tx.Exec("ALTER TABLE schedules ADD COLUMN " + c.name + " " + c.definition)
+		if err != nil {
+			return err
+		}
+	}
+
+	// add the new key before dropping the old one, so MySQL always has an index for the subscriber foreign key.
+	// DELETED_AT only has whole seconds, so it can't be in the key: removing a day, signing up for it again and
+	// removing it again in the same second would leave two removed schedules with the same one.
+	exists, err := constraintExists(tx, d, "schedules", "schedules_live_day")
+	if err != nil {
+		return err
+	}
+	if !exists {
+		_, err = tx.Exec("ALTER TABLE schedules ADD CONSTRAINT schedules_live_day UNIQUE (SUBSCRIBER_ID, TIMEZONE, DAY_KEY, REMOVED_ID)")
+		if err != nil {
+			return err
+		}
+	}
+	exists, err = constraintExists(tx, d, "schedules", "schedules_day")
+	if err != nil || !exists {
+		return err
+	}
+	_, err = tx.Exec(dropUnique(d, "schedules", "schedules_day"))
+	return err
+}
+
+// dropUnique returns the statement that drops the unique constraint name from table.
+func dropUnique(d dialect, table, name string) string {
+	if d == postgresDialect {
+		return "ALTER TABLE " + table + " DROP CONSTRAINT " + name
+	}
+	return "ALTER TABLE " + table + " DROP INDEX " + name
+}
+
+// messagesSchema is the delivery log table added in migration 5. Messages aren't deleted along with the schedule
+// they were for, so SCHEDULE_ID and REMINDER_ID aren't foreign keys.
+var messagesSchema = map[dialect][]string{
+	mysqlDialect: {
+		`CREATE TABLE IF NOT EXISTS messages(
+				   ID INT NOT NULL AUTO_INCREMENT,
+				   PHONE_NUMBER CHAR(10) NOT NULL,
+				   SCHEDULE_ID INT NOT NULL,
+				   REMINDER_ID INT NOT NULL,
+				   BODY VARCHAR(1600) NOT NULL,
+				   PROVIDER_ID VARCHAR(64) NOT NULL DEFAULT '',
+				   STATUS VARCHAR(20) NOT NULL,
+				   DUE_AT BIGINT NOT NULL,
+				   SENT_AT BIGINT NOT NULL,
+				   PRIMARY KEY  (ID),
+				   INDEX (PHONE_NUMBER, ID)
+				)`,
+	},
+	postgresDialect: {
+		`CREATE TABLE IF NOT EXISTS messages(
+				   ID SERIAL,
+				   PHONE_NUMBER VARCHAR(10) NOT NULL,
+				   SCHEDULE_ID INT NOT NULL,
+				   REMINDER_ID INT NOT NULL,
+				   BODY VARCHAR(1600) NOT NULL,
+				   PROVIDER_ID VARCHAR(64) NOT NULL DEFAULT '',
+				   STATUS VARCHAR(20) NOT NULL,
+				   DUE_AT BIGINT NOT NULL,
+				   SENT_AT BIGINT NOT NULL,
+				   PRIMARY KEY  (ID)
+				)`,
+		`CREATE INDEX IF NOT EXISTS messages_phone_number ON messages (PHONE_NUMBER, ID)`,
+	},
+}
+
+// normalizedSchema is the subscribers and schedules tables that replace alerts and parked_sides in migration 3.
+var normalizedSchema = map[dialect][]string{
+	mysqlDialect: {
+		`CREATE TABLE IF NOT EXISTS subscribers(
+				   ID INT NOT NULL AUTO_INCREMENT,
+				   PHONE_NUMBER CHAR(10) NOT NULL,
+				   COUNTRY_CODE INT NOT NULL DEFAULT 1,
+				   PARKED_SIDE VARCHAR(4) NOT NULL DEFAULT '',
+				   PRIMARY KEY  (ID),
+				   UNIQUE (PHONE_NUMBER)
+				)`,
+		`CREATE TABLE IF NOT EXISTS schedules(
+				   ID INT NOT NULL AUTO_INCREMENT,
+				   SUBSCRIBER_ID INT NOT NULL,
+				   TIMEZONE VARCHAR(100) NOT NULL,
+				   KIND VARCHAR(20) NOT NULL DEFAULT 'monthly',
+				   NTH_DAY INT NOT NULL,
+				   WEEKDAY VARCHAR(20) NOT NULL,
+				   ANCHOR_DATE VARCHAR(10) NOT NULL DEFAULT '',
+				   RRULE VARCHAR(255) NOT NULL DEFAULT '',
+				   SEASON_START CHAR(5) NOT NULL DEFAULT '',
+				   SEASON_END CHAR(5) NOT NULL DEFAULT '',
+				   START_TIME CHAR(5) NOT NULL DEFAULT '',
+				   END_TIME CHAR(5) NOT NULL DEFAULT '',
+				   SIDE VARCHAR(4) NOT NULL DEFAULT '',
+				   NEXT_CALL BIGINT NOT NULL,
+				   PRIMARY KEY  (ID),
+				   CONSTRAINT schedules_subscriber FOREIGN KEY (SUBSCRIBER_ID) REFERENCES subscribers (ID) ON DELETE CASCADE
+				)`,
+	},
+	postgresDialect: {
+		`CREATE TABLE IF NOT EXISTS subscribers(
+				   ID SERIAL,
+				   PHONE_NUMBER VARCHAR(10) NOT NULL,
+				   COUNTRY_CODE INT NOT NULL DEFAULT 1,
+				   PARKED_SIDE VARCHAR(4) NOT NULL DEFAULT '',
+				   PRIMARY KEY  (ID),
+				   UNIQUE (PHONE_NUMBER)
+				)`,
+		`CREATE TABLE IF NOT EXISTS schedules(
+				   ID SERIAL,
+				   SUBSCRIBER_ID INT NOT NULL,
+				   TIMEZONE VARCHAR(100) NOT NULL,
+				   KIND VARCHAR(20) NOT NULL DEFAULT 'monthly',
+				   NTH_DAY INT NOT NULL,
+				   WEEKDAY VARCHAR(20) NOT NULL,
+				   ANCHOR_DATE VARCHAR(10) NOT NULL DEFAULT '',
+				   RRULE VARCHAR(255) NOT NULL DEFAULT '',
+				   SEASON_START VARCHAR(5) NOT NULL DEFAULT '',
+				   SEASON_END VARCHAR(5) NOT NULL DEFAULT '',
+				   START_TIME VARCHAR(5) NOT NULL DEFAULT '',
+				   END_TIME VARCHAR(5) NOT NULL DEFAULT '',
+				   SIDE VARCHAR(4) NOT NULL DEFAULT '',
+				   NEXT_CALL BIGINT NOT NULL,
+				   PRIMARY KEY  (ID),
+				   CONSTRAINT schedules_subscriber FOREIGN KEY (SUBSCRIBER_ID) REFERENCES subscribers (ID) ON DELETE CASCADE
+				)`,
+		`CREATE INDEX IF NOT EXISTS schedules_subscriber_id ON schedules (SUBSCRIBER_ID)`,
+	},
+}
+
+// scheduleColumns are the columns alerts and schedules have in common.
+const scheduleColumns = "KIND, NTH_DAY, WEEKDAY, ANCHOR_DATE, RRULE, SEASON_START, SEASON_END, START_TIME, END_TIME, SIDE, NEXT_CALL"
+
+func normalizeAlerts(tx *sql.Tx, d dialect) error {
+	for _, s := range normalizedSchema[d] {
+		_, err := tx.Exec(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	hasAlerts, err := tableExists(tx, d, "alerts")
+	if err != nil {
+		return err
+	}
+	if hasAlerts {
+		// databases that applied migration 1 before it added these don't have them yet
+		err = addAlertsColumns(tx, d)
+		if err != nil {
+			return err
+		}
+		statements := []string{
+			`INSERT INTO subscribers (PHONE_NUMBER, COUNTRY_CODE)
+				SELECT PHONE_NUMBER, MIN(COUNTRY_CODE) FROM alerts
+				WHERE PHONE_NUMBER NOT IN (SELECT PHONE_NUMBER FROM subscribers) GROUP BY PHONE_NUMBER`,
+			`UPDATE subscribers SET PARKED_SIDE = (SELECT SIDE FROM parked_sides p WHERE p.PHONE_NUMBER = subscribers.PHONE_NUMBER)
+				WHERE PHONE_NUMBER IN (SELECT PHONE_NUMBER FROM parked_sides)`,
+			`INSERT INTO schedules (ID, SUBSCRIBER_ID, TIMEZONE, ` + scheduleColumns + `)
+				SELECT a.ID, s.ID, a.TIMEZONE, a.` + strings.Replace(scheduleColumns, ", ", ", a.", -1) + `
+				FROM alerts a JOIN subscribers s ON s.PHONE_NUMBER = a.PHONE_NUMBER
+				WHERE a.ID NOT IN (SELECT ID FROM schedules)`,
+			// reminders whose alert was deleted out from under them would break the foreign key
+			`DELETE FROM reminders WHERE ALERT_ID NOT IN (SELECT ID FROM schedules)`,
+		}
+		for _, s := range statements {
+			_, err := tx.Exec(s)
+			if err != nil {
+				return err
+			}
+		}
+		err = resetSequence(tx, d, "schedules")
+		if err != nil {
+			return err
+		}
+	}
+
+	err = renameColumn(tx, d, "reminders", "ALERT_ID", "SCHEDULE_ID")
+	if err != nil {
+		return err
+	}
+	err = renameColumn(tx, d, "late_reminders", "ALERT_ID", "SCHEDULE_ID")
+	if err != nil {
+		return err
+	}
+	hasForeignKey, err := constraintExists(tx, d, "reminders", "reminders_schedule")
+	if err != nil {
+		return err
+	}
+	if !hasForeignKey {
+		_, err = tx.Exec("ALTER TABLE reminders ADD CONSTRAINT reminders_schedule FOREIGN KEY (SCHEDULE_ID) REFERENCES schedules (ID) ON DELETE CASCADE")
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, table := range []string{"parked_sides", "alerts"} {
+		_, err := tx.Exec("DROP TABLE IF EXISTS " + table)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func flattenSchedules(tx *sql.Tx, d dialect) error {
+	for _, s := range []string{baselineTable(d, "alerts"), "ALTER TABLE alerts ADD COLUMN COUNTRY_CODE INT NOT NULL DEFAULT 1"} {
+		_, err := tx.Exec(s)
+		if err != nil {
+			return err
+		}
+	}
+	err := addAlertsColumns(tx, d)
+	if err != nil {
+		return err
+	}
+	statements := []string{
+		baselineTable(d, "parked_sides"),
+		`INSERT INTO alerts (ID, PHONE_NUMBER, COUNTRY_CODE, TIMEZONE, ` + scheduleColumns + `)
+			SELECT s.ID, u.PHONE_NUMBER, u.COUNTRY_CODE, s.TIMEZONE, s.` + strings.Replace(scheduleColumns, ", ", ", s.", -1) + `
+			FROM schedules s JOIN subscribers u ON u.ID = s.SUBSCRIBER_ID`,
+		`INSERT INTO parked_sides (PHONE_NUMBER, SIDE) SELECT PHONE_NUMBER, PARKED_SIDE FROM subscribers WHERE PARKED_SIDE <> ''`,
+	}
+	for _, s := range statements {
+		_, err := tx.Exec(s)
+		if err != nil {
+			return err
+		}
+	}
+	err = resetSequence(tx, d, "alerts")
+	if err != nil {
+		return err
+	}
+
+	dropForeignKey := "ALTER TABLE reminders DROP FOREIGN KEY reminders_schedule"
+	if d == postgresDialect {
+		dropForeignKey = "ALTER TABLE reminders DROP CONSTRAINT reminders_schedule"
+	}
+	_, err = tx.Exec(dropForeignKey)
+	if err != nil {
+		return err
+	}
+	err = renameColumn(tx, d, "reminders", "SCHEDULE_ID", "ALERT_ID")
+	if err != nil {
+		return err
+	}
+	err = renameColumn(tx, d, "late_reminders", "SCHEDULE_ID", "ALERT_ID")
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{"schedules", "subscribers"} {
+		_, err := tx.Exec("DROP TABLE IF EXISTS " + table)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uniqueSchedules gives each schedule the key of its day, merges the schedules a subscriber has more than one of in a
+// timezone into the oldest of them, drops the reminders that are then the same, and adds the unique constraints that
+// Save relies on.
+func uniqueSchedules(tx *sql.Tx, d dialect) error {
+	hasKey, err := columnExists(tx, d, "schedules", "DAY_KEY")
+	if err != nil {
+		return err
+	}
+	if !hasKey {
+		_, err = tx.Exec("ALTER TABLE schedules ADD COLUMN DAY_KEY VARCHAR(40) NOT NULL DEFAULT ''")
+		if err != nil {
+			return err
+		}
+	}
+
+	type scheduleKey struct {
+		subscriberID int
+		timezone     string
+		day          string
+	}
+	keys := map[int]string{}
+	oldest := map[scheduleKey]int{}
+	copyOf := map[int]int{}
+	rows, err := tx.Query(`SELECT ID, SUBSCRIBER_ID, TIMEZONE, KIND, NTH_DAY, WEEKDAY, ANCHOR_DATE, RRULE, SEASON_START, SEASON_END,
+		START_TIME, END_TIME, SIDE FROM schedules ORDER BY ID`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int
+		var k scheduleKey
+		var day Day
+		season := Season{}
+		err := rows.Scan(&id, &k.subscriberID, &k.timezone, &day.Kind, &day.NthWeek, &day.Weekday, &day.Anchor, &day.RRule, &season.Start, &season.End,
+			&day.Start, &day.End, &day.Side)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if season.Start != "" {
+			day.Season = &season
+		}
+		k.day = day.key()
+		if first, ok := oldest[k]; ok {
+			copyOf[id] = first
+			continue
+		}
+		oldest[k] = id
+		keys[id] = k.day
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for id, key := range keys {
+		_, err := tx.Exec(d.rebind("UPDATE schedules SET DAY_KEY = ? WHERE ID = ?"), key, id)
+		if err != nil {
+			return err
+		}
+	}
+	for id, first := range copyOf {
+		_, err := tx.Exec(d.rebind("UPDATE reminders SET SCHEDULE_ID = ? WHERE SCHEDULE_ID = ?"), first, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(d.rebind("DELETE FROM schedules WHERE ID = ?"), id)
+		if err != nil {
+			return err
+		}
+	}
+
+	type reminderKey struct {
+		scheduleID int
+		reminder   Reminder
+	}
+	seen := map[reminderKey]bool{}
+	var duplicates []int
+	rows, err = tx.Query("SELECT ID, SCHEDULE_ID, LEAD_DAYS, SEND_TIME FROM reminders ORDER BY ID")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int
+		var k reminderKey
+		err := rows.Scan(&id, &k.scheduleID, &k.reminder.DaysBefore, &k.reminder.Time)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if seen[k] {
+			duplicates = append(duplicates, id)
+		}
+		seen[k] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range duplicates {
+		_, err := tx.Exec(d.rebind("DELETE FROM reminders WHERE ID = ?"), id)
+		if err != nil {
+			return err
+		}
+	}
+	for _, first := range copyOf {
+		_, err := tx.Exec(d.rebind("UPDATE schedules SET NEXT_CALL = (SELECT MIN(NEXT_CALL) FROM reminders WHERE SCHEDULE_ID = ?) WHERE ID = ?"), first, first)
+		if err != nil {
+			return err
+		}
+	}
+
+	constraints := []struct{ table, name, columns string }{
+		{"schedules", "schedules_day", "SUBSCRIBER_ID, TIMEZONE, DAY_KEY"},
+		{"reminders", "reminders_time", "SCHEDULE_ID, LEAD_DAYS, SEND_TIME"},
+	}
+	for _, c := range constraints {
+		exists, err := constraintExists(tx, d, c.table, c.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		_, err = tx.Exec("ALTER TABLE " + c.table + " ADD CONSTRAINT " + c.name + " UNIQUE (" + c.columns + ")")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// baselineTable returns the statement in baselineSchema that creates table.
+func baselineTable(d dialect, table string) string {
+	for _, s := range baselineSchema[d] {
+		if strings.HasPrefix(s, "CREATE TABLE IF NOT EXISTS "+table+"(") {
+			return s
+		}
+	}
+	panic("no baseline table " + table)
+}
+
+// renameColumn renames one of the INT NOT NULL ID columns, unless it has already been renamed.
+func renameColumn(tx *sql.Tx, d dialect, table, from, to string) error {
+	exists, err := columnExists(tx, d, table, from)
+	if err != nil || !exists {
+		return err
+	}
+	if d == postgresDialect {
+		_, err = tx.Exec("ALTER TABLE " + table + " RENAME COLUMN " + from + " TO " + to)
+		return err
+	}
+	_, err = tx.Exec("ALTER TABLE " + table + " CHANGE " + from + " " + to + " INT NOT NULL")
+	return err
+}
+
+// resetSequence moves a postgres table's ID sequence past the IDs that were copied into it. MySQL does that on its
+// own.
+func resetSequence(tx *sql.Tx, d dialect, table string) error {
+	if d != postgresDialect {
+		return nil
+	}
+	_, err := tx.Exec("SELECT setval(pg_get_serial_sequence('" + table + "', 'id'), (SELECT COALESCE(MAX(ID), 0) + 1 FROM " + table + "), false)")
+	return err
+}
+
+func tableExists(tx *sql.Tx, d dialect, table string) (bool, error) {
+	query := `SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?`
+	if d == postgresDialect {
+		query = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = $1`
+	}
+	var count int
+	err := tx.QueryRow(query, table).Scan(&count)
+	return count > 0, err
+}
+
+// alertsColumns are the columns alerts gained before there were migrations. They were only ever in its create
+// statement, so databases created before them never got them.
+var alertsColumns = []struct{ name, mysql, postgres string }{
+	{"KIND", "VARCHAR(20) NOT NULL DEFAULT 'monthly'", "VARCHAR(20) NOT NULL DEFAULT 'monthly'"},
+	{"ANCHOR_DATE", "VARCHAR(10) NOT NULL DEFAULT ''", "VARCHAR(10) NOT NULL DEFAULT ''"},
+	{"RRULE", "VARCHAR(255) NOT NULL DEFAULT ''", "VARCHAR(255) NOT NULL DEFAULT ''"},
+	{"SEASON_START", "CHAR(5) NOT NULL DEFAULT ''", "VARCHAR(5) NOT NULL DEFAULT ''"},
+	{"SEASON_END", "CHAR(5) NOT NULL DEFAULT ''", "VARCHAR(5) NOT NULL DEFAULT ''"},
+	{"START_TIME", "CHAR(5) NOT NULL DEFAULT ''", "VARCHAR(5) NOT NULL DEFAULT ''"},
+	{"END_TIME", "CHAR(5) NOT NULL DEFAULT ''", "VARCHAR(5) NOT NULL DEFAULT ''"},
+	{"SIDE", "VARCHAR(4) NOT NULL DEFAULT ''", "VARCHAR(4) NOT NULL DEFAULT ''"},
+}
+
+// addAlertsColumns adds any of alertsColumns that alerts doesn't have.
+func addAlertsColumns(tx *sql.Tx, d dialect) error {
+	for _, c := range alertsColumns {
+		exists, err := columnExists(tx, d, "alerts", c.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		definition := c.mysql
+		if d == postgresDialect {
+			definition = c.postgres
+		}
+		_, err = tx.Exec("ALTER TABLE alerts ADD COLUMN " + c.name + " " + definition)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// baselineSchema is the schema as it was before there were migrations, in each dialect: alerts as it was first
+// created, which is all a database from back then is sure to have, and the tables added after it. The columns alerts
+// gained in that time are in alertsColumns. Postgres folds unquoted
+// names to lower case and keeps the trailing spaces CHAR pads values with, so it uses VARCHAR where MySQL uses CHAR
+// and creates its indexes separately.
+var baselineSchema = map[dialect][]string{
+	mysqlDialect: {
+		`CREATE TABLE IF NOT EXISTS alerts(
+				   ID INT NOT NULL AUTO_INCREMENT,
+				   PHONE_NUMBER CHAR(10) NOT NULL,
+				   NTH_DAY INT NOT NULL,
+				   TIMEZONE VARCHAR(100) NOT NULL,
+				   WEEKDAY VARCHAR(20) NOT NULL,
+				   NEXT_CALL BIGINT NOT NULL,
+				   PRIMARY KEY  (ID)
+				)`,
+		`CREATE TABLE IF NOT EXISTS reminders(
+				   ID INT NOT NULL AUTO_INCREMENT,
+				   ALERT_ID INT NOT NULL,
+				   LEAD_DAYS INT NOT NULL,
+				   SEND_TIME CHAR(5) NOT NULL,
+				   NEXT_CALL BIGINT NOT NULL,
+				   PRIMARY KEY  (ID),
+				   INDEX (ALERT_ID),
+				   INDEX (NEXT_CALL)
+				)`,
+		`CREATE TABLE IF NOT EXISTS parked_sides(
+				   PHONE_NUMBER CHAR(10) NOT NULL,
+				   SIDE VARCHAR(4) NOT NULL,
+				   PRIMARY KEY  (PHONE_NUMBER)
+				)`,
+		`CREATE TABLE IF NOT EXISTS late_reminders(
+				   ID INT NOT NULL AUTO_INCREMENT,
+				   REMINDER_ID INT NOT NULL,
+				   ALERT_ID INT NOT NULL,
+				   PHONE_NUMBER CHAR(10) NOT NULL,
+				   DUE_AT BIGINT NOT NULL,
+				   HANDLED_AT BIGINT NOT NULL,
+				   OUTCOME VARCHAR(20) NOT NULL,
+				   PRIMARY KEY  (ID),
+				   INDEX (DUE_AT)
+				)`,
+	},
+	postgresDialect: {
+		`CREATE TABLE IF NOT EXISTS alerts(
+				   ID SERIAL,
+				   PHONE_NUMBER VARCHAR(10) NOT NULL,
+				   NTH_DAY INT NOT NULL,
+				   TIMEZONE VARCHAR(100) NOT NULL,
+				   WEEKDAY VARCHAR(20) NOT NULL,
+				   NEXT_CALL BIGINT NOT NULL,
+				   PRIMARY KEY  (ID)
+				)`,
+		`CREATE TABLE IF NOT EXISTS reminders(
+				   ID SERIAL,
+				   ALERT_ID INT NOT NULL,
+				   LEAD_DAYS INT NOT NULL,
+				   SEND_TIME VARCHAR(5) NOT NULL,
+				   NEXT_CALL BIGINT NOT NULL,
+				   PRIMARY KEY  (ID)
+				)`,
+		`CREATE INDEX IF NOT EXISTS reminders_alert_id ON reminders (ALERT_ID)`,
+		`CREATE INDEX IF NOT EXISTS reminders_next_call ON reminders (NEXT_CALL)`,
+		`CREATE TABLE IF NOT EXISTS parked_sides(
+				   PHONE_NUMBER VARCHAR(10) NOT NULL,
+				   SIDE VARCHAR(4) NOT NULL,
+				   PRIMARY KEY  (PHONE_NUMBER)
+				)`,
+		`CREATE TABLE IF NOT EXISTS late_reminders(
+				   ID SERIAL,
+				   REMINDER_ID INT NOT NULL,
+				   ALERT_ID INT NOT NULL,
+				   PHONE_NUMBER VARCHAR(10) NOT NULL,
+				   DUE_AT BIGINT NOT NULL,
+				   HANDLED_AT BIGINT NOT NULL,
+				   OUTCOME VARCHAR(20) NOT NULL,
+				   PRIMARY KEY  (ID)
+				)`,
+		`CREATE INDEX IF NOT EXISTS late_reminders_due_at ON late_reminders (DUE_AT)`,
+	},
+}
+
+func columnExists(tx *sql.Tx, d dialect, table, column string) (bool, error) {
+	query := `SELECT COUNT(*) FROM information_schema.COLUMNS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?`
+	if d == postgresDialect {
+		query = `SELECT COUNT(*) FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2`
+		table, column = strings.ToLower(table), strings.ToLower(column)
+	}
+	var count int
+	err := tx.QueryRow(query, table, column).Scan(&count)
+	return count > 0, err
+}
+
+func constraintExists(tx *sql.Tx, d dialect, table, name string) (bool, error) {
+	query := `SELECT COUNT(*) FROM information_schema.TABLE_CONSTRAINTS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND CONSTRAINT_NAME = ?`
+	if d == postgresDialect {
+		query = `SELECT COUNT(*) FROM information_schema.table_constraints
+		WHERE table_schema = current_schema() AND table_name = $1 AND constraint_name = $2`
+	}
+	var count int
+	err := tx.QueryRow(query, table, name).Scan(&count)
+	return count > 0, err
+}
+
+func indexExists(tx *sql.Tx, d dialect, table, name string) (bool, error) {
+	query := `SELECT COUNT(*) FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?`
+	if d == postgresDialect {
+		query = `SELECT COUNT(*) FROM pg_indexes WHERE schemaname = current_schema() AND tablename = $1 AND indexname = $2`
+	}
+	var count int
+	err := tx.QueryRow(query, table, name).Scan(&count)
+	return count > 0, err
+}
+
+// appliedMigrations returns when each applied migration was applied, by version. It creates the schema_migrations
+// table that keeps track of them if there isn't one yet.
+func (s *sqlStore) appliedMigrations() (map[int]int64, error) {
+	_, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations(
+				   VERSION INT NOT NULL,
+				   NAME VARCHAR(100) NOT NULL,
+				   APPLIED_AT BIGINT NOT NULL,
+				   PRIMARY KEY  (VERSION)
+				)`)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query("SELECT VERSION, APPLIED_AT FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]int64{}
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		err := rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// migrateUp applies every migration up to and including version to that hasn't been applied yet, in order.
+func (s *sqlStore) migrateUp(to int) error {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.Version > to {
+			break
+		}
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		log.Println("applying migration ", m.Version, ": ", m.Name)
+		err := s.runMigration(m.up, "INSERT INTO schema_migrations (VERSION, NAME, APPLIED_AT) VALUES (?,?,?)", m.Version, m.Name, Now().Unix())
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %v", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// migrateDown undoes the last steps applied migrations, newest first.
+func (s *sqlStore) migrateDown(steps int) error {
+	applied, err := s.appliedMigrations()
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		log.Println("undoing migration ", m.Version, ": ", m.Name)
+		err := s.runMigration(m.down, "DELETE FROM schema_migrations WHERE VERSION = ?", m.Version)
+		if err != nil {
+			return fmt.Errorf("undoing migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		steps--
+	}
+	return nil
+}
+
+// runMigration runs change and then the statement that records it in schema_migrations in one transaction.
+func (s *sqlStore) runMigration(change func(tx *sql.Tx, d dialect) error, record string, args ...interface{}) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = change(tx, s.dialect)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(s.dialect.rebind(record), args...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateCommand applies or undoes schema migrations, or lists which ones have been applied:
+//
+//	migrate up [-to version]
+//	migrate down [-steps n]
+//	migrate status
+//
+// The server applies any pending migrations itself when it starts, so this is mostly for rolling back.
+func migrateCommand(env *Env, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down|status")
+	}
+	store, ok := env.Store.(*sqlStore)
+	if !ok {
+		return fmt.Errorf("the store doesn't have a schema to migrate")
+	}
+
+	switch args[0] {
+	case "up":
+		flags := flag.NewFlagSet("migrate up", flag.ContinueOnError)
+		to := flags.Int("to", migrations[len(migrations)-1].Version, "the version to migrate up to")
+		err := flags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		return store.migrateUp(*to)
+
+	case "down":
+		flags := flag.NewFlagSet("migrate down", flag.ContinueOnError)
+		steps := flags.Int("steps", 1, "how many migrations to undo")
+		err := flags.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		return store.migrateDown(*steps)
+
+	case "status":
+		applied, err := store.appliedMigrations()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, m := range migrations {
+			status := "pending"
+			if appliedAt, ok := applied[m.Version]; ok {
+				status = time.Unix(appliedAt, 0).UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", m.Version, m.Name, status)
+		}
+		return w.Flush()
+
+	default:
+		return fmt.Errorf("unknown migrate command %q, it should be up, down or status", args[0])
+	}
+}
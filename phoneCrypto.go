@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// phoneNumberKeys encrypts the phone numbers the SQL stores save, and makes the blind index they are looked up by.
+// Phone numbers are the only personal information we keep, so they are never saved in the clear.
+//
+// Encrypted phone numbers are saved in ENCRYPTED_PHONE columns as the ID of the key they were encrypted with, a
+// colon, and the base64 of the nonce and AES-GCM ciphertext. Keys are rotated by putting a new key in front of the
+// old ones and running the rotate-phone-keys command, which encrypts everything again with the new key; after that
+// the old key can go.
+//
+// The index, in PHONE_INDEX columns, is the HMAC-SHA256 of the phone number. Changing its key would mean no phone
+// number could be found again, so it can't be rotated.
+type phoneNumberKeys struct {
+	current  string
+	keys     map[string]cipher.AEAD
+	indexKey []byte
+}
+
+// phoneKeys is set from STREETSWEEP_PHONE_KEYS and STREETSWEEP_PHONE_INDEX_KEY when the app starts.
+var phoneKeys *phoneNumberKeys
+
+// parsePhoneKeys reads encryption keys in the form "id:base64key,id:base64key", newest first, and a base64 index
+// key. Encryption keys are 32 bytes, for AES-256, and the index key has to be at least that long.
+func parsePhoneKeys(keys, indexKey string) (*phoneNumberKeys, error) {
+	if keys == "" {
+		return nil, fmt.Errorf("there are no phone number keys")
+	}
+	k := &phoneNumberKeys{keys: map[string]cipher.AEAD{}}
+	for _, entry := range strings.Split(keys, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("phone number keys look like id:base64key, got %q", entry)
+		}
+		id := parts[0]
+		if _, ok := k.keys[id]; ok {
+			return nil, fmt.Errorf("there is more than one phone number key with ID %q", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("phone number key %q: %v", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("phone number key %q is %d bytes, it should be 32", id, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+		if k.current == "" {
+			k.current = id
+		}
+	}
+
+	var err error
+	k.indexKey, err = base64.StdEncoding.DecodeString(indexKey)
+	if err != nil {
+		return nil, fmt.Errorf("phone number index key: %v", err)
+	}
+	if len(k.indexKey) < 32 {
+		return nil, fmt.Errorf("the phone number index key is %d bytes, it should be at least 32", len(k.indexKey))
+	}
+	return k, nil
+}
+
+// encrypt encrypts phoneNumber with the current key.
+func (k *phoneNumberKeys) encrypt(phoneNumber string) (string, error) {
+	aead := k.keys[k.current]
+	nonce := make([]byte, aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(phoneNumber), nil)
+	return k.current + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (k *phoneNumberKeys) decrypt(encrypted string) (string, error) {
+	parts := strings.SplitN(encrypted, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("encrypted phone number has no key ID")
+	}
+	aead, ok := k.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("no phone number key with ID %q", parts[0])
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("encrypted phone number is too short")
+	}
+	phoneNumber, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	return string(phoneNumber), err
+}
+
+// encryptedWithCurrent reports whether encrypted was encrypted with the current key.
+func (k *phoneNumberKeys) encryptedWithCurrent(encrypted string) bool {
+	return strings.HasPrefix(encrypted, k.current+":")
+}
+
+// index returns the blind index of phoneNumber: the same phone number always has the same index, but the index
+// doesn't give the phone number away.
+func (k *phoneNumberKeys) index(phoneNumber string) string {
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(phoneNumber))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// encryptPhone returns the encrypted phoneNumber and its index, with phoneKeys.
+func encryptPhone(phoneNumber string) (encrypted, index string, err error) {
+	if phoneKeys == nil {
+		return "", "", fmt.Errorf("STREETSWEEP_PHONE_KEYS isn't set")
+	}
+	encrypted, err = phoneKeys.encrypt(phoneNumber)
+	return encrypted, phoneKeys.index(phoneNumber), err
+}
+
+// phoneIndex returns the index of phoneNumber with phoneKeys, for looking it up.
+func phoneIndex(phoneNumber string) (string, error) {
+	if phoneKeys == nil {
+		return "", fmt.Errorf("STREETSWEEP_PHONE_INDEX_KEY isn't set")
+	}
+	return phoneKeys.index(phoneNumber), nil
+}
+
+func decryptPhone(encrypted string) (string, error) {
+	if phoneKeys == nil {
+		return "", fmt.Errorf("STREETSWEEP_PHONE_KEYS isn't set")
+	}
+	return phoneKeys.decrypt(encrypted)
+}
+
+// encryptedPhoneTables are the tables with an ENCRYPTED_PHONE and its PHONE_INDEX.
+var encryptedPhoneTables = []string{"subscribers", "late_reminders", "messages", "consents"}
+
+// rotatePhoneKeysCommand encrypts every phone number that wasn't encrypted with the current key again with it, so
+// that the old keys can be retired.
+func rotatePhoneKeysCommand(env *Env, args []string) error {
+	store, ok := env.Store.(*sqlStore)
+	if !ok {
+		return fmt.Errorf("the store doesn't encrypt phone numbers")
+	}
+
+	for _, table := range encryptedPhoneTables {
+		rotated, err := store.reencryptPhones(table)
+		if err != nil {
+			return fmt.Errorf("%s: %v", table, err)
+		}
+		fmt.Printf("encrypted %d phone numbers in %s with key %s\n", rotated, table, phoneKeys.current)
+	}
+	return nil
+}
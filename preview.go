@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The number of sweeping days PreviewHandler shows for each schedule if it isn't asked for a different number, and
+// the most it will show.
+const (
+	defaultPreviewCount = 5
+	maxPreviewCount     = 52
+)
+
+// preview is what an alert would do if it were saved: the next few sweeping days for each of its times, in the
+// same order as the alert's times, and when each of their reminders would go out.
+type preview struct {
+	Times []timePreview `json:"times"`
+}
+
+type timePreview struct {
+	Occurrences []occurrence `json:"occurrences"`
+}
+
+type occurrence struct {
+	Day       string      `json:"day"`
+	Reminders []time.Time `json:"reminders"`
+}
+
+// PreviewHandler shows someone when they would be reminded before they sign up, so they can catch a schedule that
+// doesn't match their street. It takes the same alert as VerificationVerifyHandler, and the number of sweeping days
+// to show for each time in the count query parameter. Nothing is saved or sent.
+func (env *Env) PreviewHandler(w http.ResponseWriter, r *http.Request) {
+	count := defaultPreviewCount
+	if c := r.URL.Query().Get("count"); c != "" {
+		n, err := strconv.Atoi(c)
+		if err != nil || n < 1 || n > maxPreviewCount {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "count must be a number from 1 to "+strconv.Itoa(maxPreviewCount))
+			return
+		}
+		count = n
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var t alert
+	err := decoder.Decode(&t)
+	if err != nil {
+		log.Println("error decoding json: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "oops! we couldn't read that alert")
+		return
+	}
+	defer r.Body.Close()
+
+	err = t.validate()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	p, err := previewAlert(t, count)
+	if err != nil {
+		log.Println("problem previewing alert: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// previewAlert finds the next count sweeping days for each of the alert's times that still have a reminder to come.
+func previewAlert(a alert, count int) (preview, error) {
+	p := preview{Times: []timePreview{}}
+
+	location, err := time.LoadLocation(a.Timezone)
+	if err != nil {
+		return p, err
+	}
+	now := Now().In(location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	horizon := today.AddDate(yearsToSearch, 0, 0)
+
+	for _, d := range a.days() {
+		tp := timePreview{Occurrences: []occurrence{}}
+		for from := today; len(tp.Occurrences) < count; {
+			sweepDay, err := d.nextSweepDay(a.Timezone, from, horizon)
+			if err != nil {
+				// a schedule that ends, like an rrule with a COUNT, just has fewer days to show
+				break
+			}
+			from = sweepDay.AddDate(0, 0, 1)
+
+			o := occurrence{Day: sweepDay.Format(anchorLayout), Reminders: []time.Time{}}
+			for _, r := range d.reminders() {
+				if at := r.at(sweepDay); !now.After(at) {
+					o.Reminders = append(o.Reminders, at)
+				}
+			}
+			if len(o.Reminders) > 0 {
+				sort.Slice(o.Reminders, func(i, j int) bool { return o.Reminders[i].Before(o.Reminders[j]) })
+				tp.Occurrences = append(tp.Occurrences, o)
+			}
+		}
+		p.Times = append(p.Times, tp)
+	}
+	return p, nil
+}
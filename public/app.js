@@ -16,7 +16,9 @@ app.controller('signup', function ($scope, $http, $window, $timeout) {
         1: 'First',
         2: 'Second',
         3: 'Third',
-        4: 'Fourth'
+        4: 'Fourth',
+        5: 'Fifth',
+        '-1': 'Last'
     };
 
     $scope.Alert = {
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// defaultRecomputeBatch is how many reminders recompute updates in each transaction.
+const defaultRecomputeBatch = 500
+
+// nextCallChange is a reminder whose NEXT_CALL recompute would change from Old to New.
+type nextCallChange struct {
+	ReminderID int
+	ScheduleID int
+	Timezone   string
+	Old        int64
+	New        int64
+	Err        error
+}
+
+// recomputeCommand recalculates NEXT_CALL for every saved reminder with the scheduling code as it is now, for after
+// a scheduling bug is fixed or the timezone database changes. -timezone and -id limit it to the schedules in one
+// timezone or one schedule, and -dry-run lists what would change without changing anything.
+//
+// Reminders that are already due are left alone, so that FindReadyAlerts still sends them.
+func recomputeCommand(env *Env, args []string) error {
+	return env.recomputeNextCalls(os.Stdout, args)
+}
+
+// recomputeNextCalls does what the recompute command does, writing what it changes to out.
+func (env *Env) recomputeNextCalls(out io.Writer, args []string) error {
+	flags := flag.NewFlagSet("recompute", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "list the changes without saving them")
+	timezone := flags.String("timezone", "", "only recompute schedules in this timezone, like America/Los_Angeles")
+	id := flags.Int("id", 0, "only recompute the schedule with this ID")
+	batch := flags.Int("batch", defaultRecomputeBatch, "how many reminders to update in each transaction")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *batch < 1 {
+		return fmt.Errorf("-batch must be at least 1")
+	}
+
+	stored, err := env.Store.Reminders(*timezone, *id)
+	if err != nil {
+		return err
+	}
+	changes := recompute(stored)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SCHEDULE\tREMINDER\tTIMEZONE\tOLD\tNEW")
+	for _, c := range changes {
+		next := formatNextCall(c.New, c.Timezone)
+		if c.Err != nil {
+			next += " (" + c.Err.Error() + ")"
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\n", c.ScheduleID, c.ReminderID, c.Timezone, formatNextCall(c.Old, c.Timezone), next)
+	}
+	fmt.Fprintf(w, "%d of %d reminders changed\n", len(changes), len(stored))
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if *dryRun || len(changes) == 0 {
+		return nil
+	}
+	var skipped []nextCallChange
+	for start := 0; start < len(changes); start += *batch {
+		end := start + *batch
+		if end > len(changes) {
+			end = len(changes)
+		}
+		s, err := env.Store.UpdateNextCalls(changes[start:end])
+		if err != nil {
+			return fmt.Errorf("updating reminders %d to %d: %v", start+1, end, err)
+		}
+		skipped = append(skipped, s...)
+	}
+	fmt.Fprintln(out, "saved")
+	// these were moved on by something else, like FindReadyAlerts, while recompute ran
+	for _, c := range skipped {
+		fmt.Fprintf(out, "skipped reminder %d of schedule %d, its next call changed from %s since it was read\n", c.ReminderID, c.ScheduleID, formatNextCall(c.Old, c.Timezone))
+	}
+	if len(skipped) > 0 {
+		fmt.Fprintf(out, "%d reminders skipped\n", len(skipped))
+	}
+	return nil
+}
+
+// recompute works out the NEXT_CALL each stored reminder should have now, and returns the ones that differ. A
+// reminder that can no longer be scheduled is parked at math.MaxInt64, like FindReadyAlerts does.
+func recompute(stored []storedReminder) []nextCallChange {
+	now := Now().Unix()
+	var changes []nextCallChange
+	for _, s := range stored {
+		if s.NextCall <= now {
+			continue
+		}
+		nextCall, err := calculateReminderCall(s.Day, s.Reminder, s.Timezone)
+		if err != nil {
+			nextCall = math.MaxInt64
+		}
+		if nextCall != s.NextCall {
+			changes = append(changes, nextCallChange{ReminderID: s.ID, ScheduleID: s.ScheduleID, Timezone: s.Timezone, Old: s.NextCall, New: nextCall, Err: err})
+		}
+	}
+	return changes
+}
+
+func formatNextCall(call int64, timezone string) string {
+	if call == math.MaxInt64 {
+		return "never"
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		location = time.UTC
+	}
+	return time.Unix(call, 0).In(location).Format(time.RFC3339)
+}
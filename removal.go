@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The reasons a schedule can be removed for: from the website, by texting STOP, by an admin, or by the retention
+// job because texts to it can't be delivered.
+const (
+	removedOnWeb         = "web"
+	removedBySMS         = "sms_stop"
+	removedByAdmin       = "admin"
+	removedUndeliverable = "undeliverable"
+)
+
+// stopWords are the texts that unsubscribe someone. They are the ones twilio opts people out of texts for.
+var stopWords = []string{"stop", "stopall", "unsubscribe", "cancel", "end", "quit"}
+
+// defaultRemovedRetention is how long the purge-removed command keeps removed schedules by default.
+const defaultRemovedRetention = 90 * 24 * time.Hour
+
+// removal is the audit trail of a schedule being removed: when, why, and the ID of the request that removed it, so
+// that it can be found in the logs.
+type removal struct {
+	At        int64  `json:"at"`
+	Reason    string `json:"reason"`
+	RequestID string `json:"requestId"`
+}
+
+// newRemoval is a removal happening now.
+func newRemoval(reason, requestID string) removal {
+	return removal{At: Now().Unix(), Reason: reason, RequestID: requestID}
+}
+
+// requestID returns the ID heroku's router gives each request, or a new random one when running anywhere else.
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	return newRequestID()
+}
+
+// newRequestID returns a random ID, for requests and for jobs that change things.
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Println("problem making a request ID: ", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func isStopText(body string) bool {
+	body = strings.ToLower(strings.TrimSpace(body))
+	for _, w := range stopWords {
+		if body == w {
+			return true
+		}
+	}
+	return false
+}
+
+// handleStopText removes all of phoneNumber's schedules because they texted STOP, in the text with ID messageID.
+func (env *Env) handleStopText(phoneNumber, messageID string) (string, error) {
+	err := env.Store.Remove(phoneNumber, newRemoval(removedBySMS, messageID))
+	if err != nil {
+		return "", err
+	}
+	env.recordOptOut(smsConsent(phoneNumber, consentOptOut, messageID))
+	log.Println("removed alerts because they texted STOP in ", messageID)
+	return "You won't get any more street sweeping reminders. Sign up again any time at dontfearthesweeper.com", nil
+}
+
+// restore restores phoneNumber's removed schedule with ID scheduleID, or all of them if it is 0. It returns
+// errOptedOut instead if they have opted out since they last opted in.
+func (env *Env) restore(phoneNumber string, scheduleID int) ([]int, error) {
+	optedOut, err := env.optedOut(phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	if optedOut {
+		return nil, errOptedOut
+	}
+	return env.Store.Restore(phoneNumber, scheduleID)
+}
+
+// adminSchedules is a subscriber's schedules, for admins looking into what happened to them.
+type adminSchedules struct {
+	Schedules []storedSchedule `json:"schedules"`
+	Removed   []storedSchedule `json:"removed"`
+}
+
+// adminAlertsHandler handles the admin endpoints for someone's schedules:
+//
+//	GET  /admin/alerts?phoneNumber=1234567890    lists their schedules, and the removed ones with why they were removed
+//	POST /admin/alerts/remove                    removes their schedule with ID scheduleId, or all of them
+//	POST /admin/alerts/restore                   restores their removed schedule with ID scheduleId, or all of them
+//
+// The POSTs take a JSON body with the phoneNumber and scheduleId. Removing all of someone's schedules records an opt
+// out for them, and nothing is restored for someone whose latest consent is an opt out, until they sign up again.
+func (env *Env) adminAlertsHandler(w http.ResponseWriter, r *http.Request) {
+	if !env.isAdmin(r) {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, "not authorized")
+		return
+	}
+
+	if r.URL.Path == "/admin/alerts" {
+		phoneNumber := r.URL.Query().Get("phoneNumber")
+		schedules, err := env.Store.Schedules(phoneNumber)
+		if err != nil {
+			log.Println("problem finding schedules: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "oops! we made a mistake")
+			return
+		}
+		removed, err := env.Store.RemovedSchedules(phoneNumber)
+		if err != nil {
+			log.Println("problem finding removed schedules: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "oops! we made a mistake")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(adminSchedules{Schedules: schedules, Removed: removed})
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	decoder := json.NewDecoder(r.Body)
+	var t removeAlert
+	err := decoder.Decode(&t)
+	if err != nil {
+		log.Println("error decoding json: ", err)
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "bad json")
+		return
+	}
+	defer r.Body.Close()
+
+	switch r.URL.Path {
+	case "/admin/alerts/remove":
+		found := true
+		why := newRemoval(removedByAdmin, requestID(r))
+		if t.ScheduleID != 0 {
+			found, err = env.Store.RemoveSchedule(t.PhoneNumber, t.ScheduleID, why)
+		} else {
+			err = env.Store.Remove(t.PhoneNumber, why)
+		}
+		if err != nil {
+			log.Println("problem removing alerts: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "oops! we made a mistake")
+			return
+		}
+		if !found {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, "no such schedule")
+			return
+		}
+		// removing all of them is them asking, through us, to stop getting texts
+		if t.ScheduleID == 0 {
+			c := webConsent(r, t.PhoneNumber, consentOptOut)
+			c.Source = consentFromAdmin
+			env.recordOptOut(c)
+		}
+		log.Println("admin removed alerts in request ", why.RequestID)
+		w.WriteHeader(http.StatusOK)
+
+	case "/admin/alerts/restore":
+		restored, err := env.restore(t.PhoneNumber, t.ScheduleID)
+		if err == errOptedOut {
+			w.WriteHeader(http.StatusConflict)
+			io.WriteString(w, err.Error())
+			return
+		}
+		if err != nil {
+			log.Println("problem restoring alerts: ", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "oops! we made a mistake")
+			return
+		}
+		if restored == nil {
+			restored = []int{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string][]int{"restored": restored})
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// purgeRemovedCommand deletes the schedules that were removed longer ago than -older-than.
+func purgeRemovedCommand(env *Env, args []string) error {
+	flags := flag.NewFlagSet("purge-removed", flag.ContinueOnError)
+	olderThan := flags.Duration("older-than", defaultRemovedRetention, "delete schedules removed longer ago than this")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	purged, err := env.Store.PurgeRemoved(Now().Add(-*olderThan).Unix())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("purged %d removed schedules\n", purged)
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// retentionInterval is how often the retention job runs. Heroku restarts the app every day, so it has to be more
+// often than that to ever run at all.
+const retentionInterval = time.Hour
+
+// retentionPolicy is what the retention job deletes. A zero age or count turns that part of it off.
+type retentionPolicy struct {
+	// MessageAge is how long texts are kept in the delivery log.
+	MessageAge time.Duration
+	// MaxUndeliverable is how many texts in a row can be undeliverable before the subscriber's schedules are removed.
+	MaxUndeliverable int
+	// RemovedAge is how long removed schedules are kept.
+	RemovedAge time.Duration
+}
+
+var defaultRetentionPolicy = retentionPolicy{
+	MessageAge:       365 * 24 * time.Hour,
+	MaxUndeliverable: 3,
+	RemovedAge:       defaultRemovedRetention,
+}
+
+// retentionPolicyFromEnv reads the retention policy from STREETSWEEP_MESSAGE_RETENTION_DAYS,
+// STREETSWEEP_MAX_UNDELIVERABLE and STREETSWEEP_REMOVED_RETENTION_DAYS, using the default for any that aren't set.
+func retentionPolicyFromEnv() (retentionPolicy, error) {
+	policy := defaultRetentionPolicy
+	settings := []struct {
+		variable string
+		set      func(n int)
+	}{
+		{"STREETSWEEP_MESSAGE_RETENTION_DAYS", func(n int) { policy.MessageAge = time.Duration(n) * 24 * time.Hour }},
+		{"STREETSWEEP_MAX_UNDELIVERABLE", func(n int) { policy.MaxUndeliverable = n }},
+		{"STREETSWEEP_REMOVED_RETENTION_DAYS", func(n int) { policy.RemovedAge = time.Duration(n) * 24 * time.Hour }},
+	}
+	for _, setting := range settings {
+		value := os.Getenv(setting.variable)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return policy, fmt.Errorf("%s must be a number of at least 0, got %q", setting.variable, value)
+		}
+		setting.set(n)
+	}
+	return policy, nil
+}
+
+// retentionSummary is what one run of the retention job did.
+type retentionSummary struct {
+	MessagesPurged         int
+	SubscribersRemoved     int
+	RemovedSchedulesPurged int
+}
+
+// applyRetention deletes what policy says we shouldn't keep any more, and removes the schedules of subscribers our
+// texts can't reach. It carries on with the rest if one part fails, and returns the first error.
+func (env *Env) applyRetention(policy retentionPolicy) (retentionSummary, error) {
+	var summary retentionSummary
+	var firstErr error
+	fail := func(err error) {
+		log.Println("problem applying the retention policy: ", err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if policy.MessageAge > 0 {
+		purged, err := env.Store.PurgeMessages(Now().Add(-policy.MessageAge).Unix())
+		if err != nil {
+			fail(err)
+		}
+		summary.MessagesPurged = purged
+	}
+
+	if policy.MaxUndeliverable > 0 {
+		phoneNumbers, err := env.Store.UndeliverableSubscribers(policy.MaxUndeliverable)
+		if err != nil {
+			fail(err)
+		}
+		why := newRemoval(removedUndeliverable, newRequestID())
+		for _, phoneNumber := range phoneNumbers {
+			err := env.Store.Remove(phoneNumber, why)
+			if err != nil {
+				fail(err)
+				continue
+			}
+			summary.SubscribersRemoved++
+		}
+	}
+
+	// schedules removed just now aren't old enough to be purged, so this comes last
+	if policy.RemovedAge > 0 {
+		purged, err := env.Store.PurgeRemoved(Now().Add(-policy.RemovedAge).Unix())
+		if err != nil {
+			fail(err)
+		}
+		summary.RemovedSchedulesPurged = purged
+	}
+	return summary, firstErr
+}
+
+// runRetention runs the retention job and logs what it did.
+func (env *Env) runRetention(policy retentionPolicy) {
+	summary, err := env.applyRetention(policy)
+	status := "ok"
+	if err != nil {
+		status = "with errors"
+	}
+	log.Printf("retention %s: purged %d messages, removed %d undeliverable subscribers, purged %d removed schedules",
+		status, summary.MessagesPurged, summary.SubscribersRemoved, summary.RemovedSchedulesPurged)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// rrule is the part of an RFC 5545 recurrence rule that makes sense for street sweeping. Sweeping happens on whole
+// days, so rules are expanded to dates and anything finer than a day (BYHOUR, BYMINUTE, ...) is rejected.
+type rrule struct {
+	freq       string
+	interval   int
+	count      int
+	until      time.Time
+	byDay      []rruleDay
+	byMonthDay []int
+	byMonth    []int
+	bySetPos   []int
+	wkst       time.Weekday
+}
+
+// rruleDay is one BYDAY entry, like TU or 3TU or -1FR. An nth of 0 means every matching weekday in the period.
+type rruleDay struct {
+	nth     int
+	weekday time.Weekday
+}
+
+// parseRRule parses a recurrence rule like "FREQ=MONTHLY;BYDAY=1TU,3TU;BYMONTH=4,5,6,7,8,9,10".
+func parseRRule(s string) (*rrule, error) {
+	r := &rrule{interval: 1, wkst: time.Monday}
+
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	if s == "" {
+		return nil, fmt.Errorf("rrule: empty rule")
+	}
+
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("rrule: malformed part %q", part)
+		}
+		name, value := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+
+		var err error
+		switch name {
+		case "FREQ":
+			switch value {
+			case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+				r.freq = value
+			default:
+				return nil, fmt.Errorf("rrule: unsupported FREQ %q", value)
+			}
+		case "INTERVAL":
+			r.interval, err = strconv.Atoi(value)
+			if err != nil || r.interval < 1 {
+				return nil, fmt.Errorf("rrule: bad INTERVAL %q", value)
+			}
+		case "COUNT":
+			r.count, err = strconv.Atoi(value)
+			if err != nil || r.count < 1 {
+				return nil, fmt.Errorf("rrule: bad COUNT %q", value)
+			}
+		case "UNTIL":
+			if len(value) < 8 {
+				return nil, fmt.Errorf("rrule: bad UNTIL %q", value)
+			}
+			r.until, err = time.Parse("20060102", value[:8])
+			if err != nil {
+				return nil, fmt.Errorf("rrule: bad UNTIL %q", value)
+			}
+		case "BYDAY":
+			for _, v := range strings.Split(value, ",") {
+				d, err := parseRRuleDay(v)
+				if err != nil {
+					return nil, err
+				}
+				r.byDay = append(r.byDay, d)
+			}
+		case "BYMONTHDAY":
+			r.byMonthDay, err = parseRRuleInts(name, value, 31)
+		case "BYMONTH":
+			r.byMonth, err = parseRRuleInts(name, value, 12)
+			for _, m := range r.byMonth {
+				if m < 0 {
+					return nil, fmt.Errorf("rrule: bad BYMONTH %q", value)
+				}
+			}
+		case "BYSETPOS":
+			r.bySetPos, err = parseRRuleInts(name, value, 366)
+		case "WKST":
+			wkst, ok := rruleWeekdays[value]
+			if !ok {
+				return nil, fmt.Errorf("rrule: bad WKST %q", value)
+			}
+			r.wkst = wkst
+		default:
+			return nil, fmt.Errorf("rrule: %s is not supported", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if r.freq == "" {
+		return nil, fmt.Errorf("rrule: FREQ is required")
+	}
+	if r.count > 0 && !r.until.IsZero() {
+		return nil, fmt.Errorf("rrule: COUNT and UNTIL can't both be set")
+	}
+	for _, d := range r.byDay {
+		if d.nth != 0 && r.freq != "MONTHLY" && r.freq != "YEARLY" {
+			return nil, fmt.Errorf("rrule: BYDAY can only have a number like 1TU when FREQ is MONTHLY or YEARLY")
+		}
+	}
+	if len(r.byMonthDay) > 0 && r.freq == "WEEKLY" {
+		return nil, fmt.Errorf("rrule: BYMONTHDAY can't be used when FREQ is WEEKLY")
+	}
+
+	return r, nil
+}
+
+func parseRRuleDay(s string) (rruleDay, error) {
+	if len(s) < 2 {
+		return rruleDay{}, fmt.Errorf("rrule: bad BYDAY %q", s)
+	}
+	weekday, ok := rruleWeekdays[s[len(s)-2:]]
+	if !ok {
+		return rruleDay{}, fmt.Errorf("rrule: bad BYDAY %q", s)
+	}
+	d := rruleDay{weekday: weekday}
+	if len(s) > 2 {
+		nth, err := strconv.Atoi(s[:len(s)-2])
+		if err != nil || nth == 0 || nth > 53 || nth < -53 {
+			return rruleDay{}, fmt.Errorf("rrule: bad BYDAY %q", s)
+		}
+		d.nth = nth
+	}
+	return d, nil
+}
+
+func parseRRuleInts(name, value string, max int) ([]int, error) {
+	var ints []int
+	for _, v := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(v)
+		if err != nil || n == 0 || n > max || n < -max {
+			return nil, fmt.Errorf("rrule: bad %s %q", name, value)
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+// needsStart is true if the rule can't be expanded without knowing its first occurrence (its DTSTART), either
+// because it counts periods or occurrences from there or because it takes its day from there.
+func (r *rrule) needsStart() bool {
+	if r.interval > 1 || r.count > 0 {
+		return true
+	}
+	switch r.freq {
+	case "WEEKLY":
+		return len(r.byDay) == 0
+	case "MONTHLY":
+		return len(r.byDay) == 0 && len(r.byMonthDay) == 0
+	case "YEARLY":
+		return len(r.byDay) == 0 && len(r.byMonthDay) == 0
+	}
+	return false
+}
+
+// nextOnOrAfter returns midnight of the first day on or after from that the rule happens on. start is the rule's
+// first occurrence; if it is the zero time the rule is treated as always having been in effect.
+func (r *rrule) nextOnOrAfter(start, from time.Time) (time.Time, error) {
+	var next time.Time
+	err := r.occurrences(start, from, func(day time.Time) bool {
+		next = day
+		return false
+	})
+	return next, err
+}
+
+// occurrences calls f with midnight of each day on or after from that the rule happens on, in order, until f returns
+// false. start is as for nextOnOrAfter. It returns an error if the rule runs out of days, or has none in the
+// yearsToSearch years after from, before f returns false.
+func (r *rrule) occurrences(start, from time.Time, f func(day time.Time) bool) error {
+	if start.IsZero() {
+		if r.needsStart() {
+			return fmt.Errorf("rrule: this rule needs a start date")
+		}
+		start = from
+	}
+
+	horizon := from.AddDate(yearsToSearch, 0, 0)
+	n := 0
+	for period := r.periodStart(start); !period.After(horizon); period = r.nextPeriod(period) {
+		for _, day := range r.expand(period, start) {
+			if day.Before(start) {
+				continue
+			}
+			if !r.until.IsZero() && daysBetween(r.until, day) > 0 {
+				return fmt.Errorf("rrule: no occurrences after %s", r.until.Format(anchorLayout))
+			}
+			n++
+			if r.count > 0 && n > r.count {
+				return fmt.Errorf("rrule: all %d occurrences are over", r.count)
+			}
+			if !day.Before(from) && !f(day) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("rrule: no occurrence in the next %d years", yearsToSearch)
+}
+
+func (r *rrule) periodStart(t time.Time) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	switch r.freq {
+	case "WEEKLY":
+		return day.AddDate(0, 0, -((int(day.Weekday()) - int(r.wkst) + 7) % 7))
+	case "MONTHLY":
+		return day.AddDate(0, 0, 1-day.Day())
+	case "YEARLY":
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, t.Location())
+	}
+	return day
+}
+
+func (r *rrule) nextPeriod(period time.Time) time.Time {
+	switch r.freq {
+	case "WEEKLY":
+		return period.AddDate(0, 0, 7*r.interval)
+	case "MONTHLY":
+		return period.AddDate(0, r.interval, 0)
+	case "YEARLY":
+		return period.AddDate(r.interval, 0, 0)
+	}
+	return period.AddDate(0, 0, r.interval)
+}
+
+// expand returns the sorted days the rule happens on in the period starting at period.
+func (r *rrule) expand(period, start time.Time) []time.Time {
+	var days []time.Time
+	switch r.freq {
+	case "DAILY":
+		if r.matchesWeekday(period) && r.matchesMonthDay(period) {
+			days = append(days, period)
+		}
+	case "WEEKLY":
+		for i := 0; i < 7; i++ {
+			day := period.AddDate(0, 0, i)
+			if len(r.byDay) == 0 && day.Weekday() == start.Weekday() || len(r.byDay) > 0 && r.matchesWeekday(day) {
+				days = append(days, day)
+			}
+		}
+	case "MONTHLY":
+		days = r.expandMonth(period, start)
+	case "YEARLY":
+		if len(r.byMonth) == 0 && len(r.byMonthDay) == 0 && len(r.byDay) > 0 {
+			days = r.expandWeekdays(period, period.AddDate(1, 0, 0))
+			break
+		}
+		for month := 1; month <= 12; month++ {
+			if len(r.byMonth) == 0 && len(r.byMonthDay) == 0 && len(r.byDay) == 0 && time.Month(month) != start.Month() {
+				continue
+			}
+			days = append(days, r.expandMonth(period.AddDate(0, month-1, 0), start)...)
+		}
+	}
+
+	var inMonth []time.Time
+	for _, day := range days {
+		if len(r.byMonth) == 0 || containsInt(r.byMonth, int(day.Month())) {
+			inMonth = append(inMonth, day)
+		}
+	}
+	return r.applySetPos(inMonth)
+}
+
+// expandMonth returns the days in the month starting at first that match BYMONTHDAY and BYDAY, or start's day of
+// the month if neither is set.
+func (r *rrule) expandMonth(first, start time.Time) []time.Time {
+	next := first.AddDate(0, 1, 0)
+	if len(r.byDay) == 0 && len(r.byMonthDay) == 0 {
+		day := first.AddDate(0, 0, start.Day()-1)
+		if day.Before(next) {
+			return []time.Time{day}
+		}
+		return nil
+	}
+
+	var days []time.Time
+	if len(r.byDay) > 0 {
+		for _, day := range r.expandWeekdays(first, next) {
+			if r.matchesMonthDay(day) {
+				days = append(days, day)
+			}
+		}
+		return days
+	}
+	for day := first; day.Before(next); day = day.AddDate(0, 0, 1) {
+		if r.matchesMonthDay(day) {
+			days = append(days, day)
+		}
+	}
+	return days
+}
+
+// expandWeekdays returns the days from first up to (not including) next that match BYDAY, counting numbered
+// entries like 2TU or -1FR from the start or end of that range.
+func (r *rrule) expandWeekdays(first, next time.Time) []time.Time {
+	var days []time.Time
+	for _, d := range r.byDay {
+		var matches []time.Time
+		for day := first.AddDate(0, 0, (int(d.weekday)-int(first.Weekday())+7)%7); day.Before(next); day = day.AddDate(0, 0, 7) {
+			matches = append(matches, day)
+		}
+		switch {
+		case d.nth == 0:
+			days = append(days, matches...)
+		case d.nth > 0 && d.nth <= len(matches):
+			days = append(days, matches[d.nth-1])
+		case d.nth < 0 && -d.nth <= len(matches):
+			days = append(days, matches[len(matches)+d.nth])
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return uniqueDays(days)
+}
+
+func (r *rrule) matchesWeekday(day time.Time) bool {
+	if len(r.byDay) == 0 {
+		return true
+	}
+	for _, d := range r.byDay {
+		if d.weekday == day.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rrule) matchesMonthDay(day time.Time) bool {
+	if len(r.byMonthDay) == 0 {
+		return true
+	}
+	daysInMonth := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, day.Location()).Day()
+	for _, n := range r.byMonthDay {
+		if n == day.Day() || n < 0 && daysInMonth+n+1 == day.Day() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rrule) applySetPos(days []time.Time) []time.Time {
+	if len(r.bySetPos) == 0 {
+		return days
+	}
+	var picked []time.Time
+	for _, pos := range r.bySetPos {
+		switch {
+		case pos > 0 && pos <= len(days):
+			picked = append(picked, days[pos-1])
+		case pos < 0 && -pos <= len(days):
+			picked = append(picked, days[len(days)+pos])
+		}
+	}
+	sort.Slice(picked, func(i, j int) bool { return picked[i].Before(picked[j]) })
+	return uniqueDays(picked)
+}
+
+func uniqueDays(days []time.Time) []time.Time {
+	var unique []time.Time
+	for i, day := range days {
+		if i == 0 || !day.Equal(days[i-1]) {
+			unique = append(unique, day)
+		}
+	}
+	return unique
+}
+
+func containsInt(ints []int, n int) bool {
+	for _, i := range ints {
+		if i == n {
+			return true
+		}
+	}
+	return false
+}
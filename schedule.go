@@ -0,0 +1,449 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// The kinds of schedule a Day can describe. An empty Kind is treated as kindMonthly so that alerts saved before
+// there were kinds keep working.
+const (
+	kindMonthly  = "monthly"
+	kindWeekly   = "weekly"
+	kindBiweekly = "biweekly"
+	kindRRule    = "rrule"
+)
+
+// The nthWeek values 1 through 4 always exist in a month. fifthWeek only exists in some months, and lastWeek is
+// whichever of the fourth or fifth is last in the month.
+const (
+	fifthWeek = 5
+	lastWeek  = -1
+)
+
+// anchorLayout is the format of a biweekly or rrule schedule's anchor date.
+const anchorLayout = "2006-01-02"
+
+// monthsToSearch is how many months ahead CalculateNextCall looks for the next matching day. A fifth weekday can
+// be missing from several months in a row, so this has to be more than just this month and the next.
+const monthsToSearch = 12
+
+// yearsToSearch is the search horizon: how far ahead CalculateNextCall and NextCallAfter keep looking for a
+// sweeping day that is in season before deciding there isn't one.
+const yearsToSearch = 5
+
+// Day is one street sweeping schedule. Monthly schedules sweep on the NthWeek Weekday of every month, weekly
+// schedules sweep every Weekday, and biweekly schedules sweep every other week starting on the Anchor date. Rrule
+// schedules sweep whenever their RFC 5545 RRule says to, using Anchor as the rule's start date if it has one.
+type Day struct {
+	Kind    string  `json:"kind"`
+	Weekday int     `json:"weekday"`
+	NthWeek int     `json:"nthWeek"`
+	Anchor  string  `json:"anchor"`
+	RRule   string  `json:"rrule"`
+	Season  *Season `json:"season,omitempty"`
+
+	// Start and End are the 24 hour local times that sweeping happens between, like "08:00" and "10:00". They are
+	// optional, but if one is set the other has to be too.
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+
+	// Side is the side of the street, odd or even addresses, that the schedule sweeps. It is empty if the schedule
+	// sweeps both sides.
+	Side string `json:"side,omitempty"`
+
+	Reminders []Reminder `json:"reminders,omitempty"`
+}
+
+// parseClock turns a 24 hour time like "19:00" into minutes after midnight.
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("times must look like 19:00, got %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// formatClock turns a 24 hour time like "08:00" or "13:30" into "8am" or "1:30pm" for people to read.
+func formatClock(s string) string {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return s
+	}
+	if t.Minute() == 0 {
+		return t.Format("3pm")
+	}
+	return t.Format("3:04pm")
+}
+
+// overlaps reports whether two schedules sweep the same side of the street on the same day during the next year
+// with time windows that overlap. Schedules without a time window never overlap.
+func (d Day) overlaps(other Day, location *time.Location) bool {
+	if d.Start == "" || other.Start == "" {
+		return false
+	}
+	if d.Side != "" && other.Side != "" && d.Side != other.Side {
+		return false
+	}
+	start, _ := parseClock(d.Start)
+	end, _ := parseClock(d.End)
+	otherStart, _ := parseClock(other.Start)
+	otherEnd, _ := parseClock(other.End)
+	if start >= otherEnd || otherStart >= end {
+		return false
+	}
+
+	now := Now().In(location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	nextYear := today.AddDate(1, 0, 0)
+	sweepDays := make(map[string]bool)
+	d.eachSweepDay(today, nextYear, func(day time.Time) bool {
+		sweepDays[day.Format(anchorLayout)] = true
+		return true
+	})
+	shared := false
+	other.eachSweepDay(today, nextYear, func(day time.Time) bool {
+		shared = sweepDays[day.Format(anchorLayout)]
+		return !shared
+	})
+	return shared
+}
+
+// Reminder is when to text someone about a sweeping day: DaysBefore days ahead of it at Time, a 24 hour local time
+// like "19:00".
+type Reminder struct {
+	DaysBefore int    `json:"daysBefore"`
+	Time       string `json:"time"`
+}
+
+// maxDaysBefore is the furthest ahead of a sweeping day that a reminder can be sent.
+const maxDaysBefore = 14
+
+// defaultReminder is the reminder for alerts that don't ask for a different one: 7pm the night before.
+var defaultReminder = Reminder{DaysBefore: 1, Time: "19:00"}
+
+func (r Reminder) validate() error {
+	if r.DaysBefore < 0 || r.DaysBefore > maxDaysBefore {
+		return fmt.Errorf("reminders can be sent between 0 and %d days before sweeping, got %d", maxDaysBefore, r.DaysBefore)
+	}
+	_, err := parseClock(r.Time)
+	return err
+}
+
+// at returns when to send the reminder for a sweep on sweepDay.
+func (r Reminder) at(sweepDay time.Time) time.Time {
+	minutes, _ := parseClock(r.Time)
+	return time.Date(sweepDay.Year(), sweepDay.Month(), sweepDay.Day()-r.DaysBefore, minutes/60, minutes%60, 0, 0, sweepDay.Location())
+}
+
+// sweepDay works backwards from a time the reminder was due to the sweeping day it was for.
+func (r Reminder) sweepDay(call time.Time) time.Time {
+	return time.Date(call.Year(), call.Month(), call.Day()+r.DaysBefore, 0, 0, 0, 0, call.Location())
+}
+
+// Season is the part of every year that sweeping happens in. Start and End are month-day dates like "04-01" and
+// are both included. A season can wrap around new year, like "11-01" through "02-28".
+type Season struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+func (s *Season) validate() error {
+	if _, err := parseMonthDay(s.Start); err != nil {
+		return err
+	}
+	_, err := parseMonthDay(s.End)
+	return err
+}
+
+// contains reports whether day falls in the season. A nil season is the whole year.
+func (s *Season) contains(day time.Time) bool {
+	if s == nil {
+		return true
+	}
+	start, _ := parseMonthDay(s.Start)
+	end, _ := parseMonthDay(s.End)
+	md := int(day.Month())*100 + day.Day()
+	if start <= end {
+		return start <= md && md <= end
+	}
+	return md >= start || md <= end
+}
+
+// parseMonthDay turns "04-01" into 401 so that month-days can be compared as numbers.
+func parseMonthDay(s string) (int, error) {
+	var month, day int
+	_, err := fmt.Sscanf(s, "%02d-%02d", &month, &day)
+	if err != nil || len(s) != 5 || month < 1 || month > 12 || day < 1 ||
+		day > time.Date(2000, time.Month(month)+1, 0, 0, 0, 0, 0, time.UTC).Day() {
+		return 0, fmt.Errorf("season dates must look like 04-01, got %q", s)
+	}
+	return month*100 + day, nil
+}
+
+// reminders returns when the schedule's texts are sent, or just the default reminder if it doesn't say.
+func (d Day) reminders() []Reminder {
+	if len(d.Reminders) == 0 {
+		return []Reminder{defaultReminder}
+	}
+	return d.Reminders
+}
+
+func (d Day) kind() string {
+	if d.Kind == "" {
+		return kindMonthly
+	}
+	return d.Kind
+}
+
+func (d Day) validate() error {
+	if d.Weekday < 0 || d.Weekday > 6 {
+		return fmt.Errorf("weekday must be between 0 and 6, got %d", d.Weekday)
+	}
+	if d.Season != nil {
+		if err := d.Season.validate(); err != nil {
+			return err
+		}
+	}
+	if d.Side != "" && !validSide(d.Side) {
+		return fmt.Errorf("side must be %q, %q or left out for both sides, got %q", sideOdd, sideEven, d.Side)
+	}
+	if d.Start != "" || d.End != "" {
+		start, err := parseClock(d.Start)
+		if err != nil {
+			return err
+		}
+		end, err := parseClock(d.End)
+		if err != nil {
+			return err
+		}
+		if start >= end {
+			return fmt.Errorf("sweeping from %s to %s ends before it starts", d.Start, d.End)
+		}
+	}
+	for i, r := range d.Reminders {
+		if err := r.validate(); err != nil {
+			return err
+		}
+		for _, other := range d.Reminders[:i] {
+			if r == other {
+				return fmt.Errorf("reminder %d days before at %s is listed twice", r.DaysBefore, r.Time)
+			}
+		}
+	}
+
+	switch d.kind() {
+	case kindMonthly:
+		if d.NthWeek != lastWeek && (d.NthWeek < 1 || d.NthWeek > fifthWeek) {
+			return fmt.Errorf("nthWeek must be between 1 and %d, or %d for the last week, got %d", fifthWeek, lastWeek, d.NthWeek)
+		}
+	case kindWeekly:
+	case kindBiweekly:
+		anchor, err := time.Parse(anchorLayout, d.Anchor)
+		if err != nil {
+			return fmt.Errorf("biweekly schedules need an anchor date like 2017-09-05, got %q", d.Anchor)
+		}
+		if int(anchor.Weekday()) != d.Weekday {
+			return fmt.Errorf("anchor date %s is a %s, not a %s", d.Anchor, anchor.Weekday(), time.Weekday(d.Weekday))
+		}
+	case kindRRule:
+		rule, err := parseRRule(d.RRule)
+		if err != nil {
+			return err
+		}
+		if d.Anchor != "" {
+			if _, err := time.Parse(anchorLayout, d.Anchor); err != nil {
+				return fmt.Errorf("anchor date must look like 2017-09-05, got %q", d.Anchor)
+			}
+		} else if rule.needsStart() {
+			return fmt.Errorf("rrule %q needs an anchor date to start from", d.RRule)
+		}
+	default:
+		return fmt.Errorf("unknown schedule kind %q", d.Kind)
+	}
+	return nil
+}
+
+// CalculateNextCall takes a sweeping schedule and a timezone and calculates the next time that a person should be
+// alerted for street sweeping, which is the soonest of any of the schedule's reminders.
+func CalculateNextCall(d Day, timezone string) (int64, error) {
+
+	var NextCallUnixTime int64
+
+	for i, r := range d.reminders() {
+		nextCall, err := calculateReminderCall(d, r, timezone)
+		if err != nil {
+			return NextCallUnixTime, err
+		}
+		if i == 0 || nextCall < NextCallUnixTime {
+			NextCallUnixTime = nextCall
+		}
+	}
+
+	return NextCallUnixTime, nil
+}
+
+// calculateReminderCall calculates the next time to send reminder r for a sweeping schedule.
+func calculateReminderCall(d Day, r Reminder, timezone string) (int64, error) {
+
+	var NextCallUnixTime int64
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return NextCallUnixTime, err
+	}
+
+	now := Now().In(location)
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	horizon := from.AddDate(yearsToSearch, 0, 0)
+	for {
+		sweepDay, err := d.nextSweepDay(timezone, from, horizon)
+		if err != nil {
+			return NextCallUnixTime, err
+		}
+		timeToSendMessage := r.at(sweepDay)
+		if !now.After(timeToSendMessage) {
+			NextCallUnixTime = timeToSendMessage.Unix()
+			return NextCallUnixTime, nil
+		}
+		from = sweepDay.AddDate(0, 0, 1)
+	}
+}
+
+// NextCallAfter calculates when to send reminder r for the sweeping day after the one that the reminder due at call
+// was for. FindReadyAlerts uses it instead of CalculateNextCall once a reminder has been handled: moving on from the
+// sweeping day that was just handled, rather than from whatever time it is now, means a scheduler that runs late
+// hands the next sweeping day to the catch-up policy instead of silently skipping it.
+func NextCallAfter(d Day, r Reminder, timezone string, call int64) (int64, error) {
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return 0, err
+	}
+
+	handled := r.sweepDay(time.Unix(call, 0).In(location))
+	from := handled.AddDate(0, 0, 1)
+	sweepDay, err := d.nextSweepDay(timezone, from, from.AddDate(yearsToSearch, 0, 0))
+	if err != nil {
+		return 0, err
+	}
+	return r.at(sweepDay).Unix(), nil
+}
+
+// nextSweepDay returns midnight of the first day on or after from, and no later than horizon, that the street is
+// actually swept. Sweeping days outside of the schedule's season, and holidays in the holiday calendar for the
+// timezone, are skipped.
+func (d Day) nextSweepDay(timezone string, from, horizon time.Time) (time.Time, error) {
+	for {
+		sweepDay, err := d.sweepDayOnOrAfter(from)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if sweepDay.After(horizon) {
+			return time.Time{}, fmt.Errorf("no sweeping day in season and off holiday before %s", horizon.Format(anchorLayout))
+		}
+		if d.Season.contains(sweepDay) && !holidays.isHoliday(timezone, sweepDay) {
+			return sweepDay, nil
+		}
+		from = sweepDay.AddDate(0, 0, 1)
+	}
+}
+
+// sweepDayOnOrAfter returns midnight of the first day on or after from that the street is swept.
+func (d Day) sweepDayOnOrAfter(from time.Time) (time.Time, error) {
+	switch d.kind() {
+	case kindWeekly:
+		return from.AddDate(0, 0, (d.Weekday-int(from.Weekday())+7)%7), nil
+
+	case kindBiweekly:
+		anchor, err := time.ParseInLocation(anchorLayout, d.Anchor, from.Location())
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !from.After(anchor) {
+			return anchor, nil
+		}
+		weeks := (daysBetween(anchor, from) + 13) / 14
+		return anchor.AddDate(0, 0, weeks*14), nil
+
+	case kindRRule:
+		rule, start, err := d.parseRRule(from.Location())
+		if err != nil {
+			return time.Time{}, err
+		}
+		return rule.nextOnOrAfter(start, from)
+
+	default:
+		firstOfMonth := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, from.Location())
+		for i := 0; i <= monthsToSearch; i++ {
+			sweepDay, ok := nthDayOfMonth(firstOfMonth.AddDate(0, i, 0), d.NthWeek, d.Weekday)
+			if ok && !sweepDay.Before(from) {
+				return sweepDay, nil
+			}
+		}
+		return time.Time{}, fmt.Errorf("no nth week %d of weekday %d in the next %d months", d.NthWeek, d.Weekday, monthsToSearch)
+	}
+}
+
+// eachSweepDay calls f with midnight of each day from from up to until that the street is swept, in order, until f
+// returns false. It stops early if the street stops being swept, or if the day can't be worked out. Unlike calling
+// sweepDayOnOrAfter over and over, it parses an rrule only once and walks it from its start only once.
+func (d Day) eachSweepDay(from, until time.Time, f func(day time.Time) bool) {
+	if d.kind() == kindRRule {
+		rule, start, err := d.parseRRule(from.Location())
+		if err != nil {
+			return
+		}
+		rule.occurrences(start, from, func(day time.Time) bool {
+			return day.Before(until) && f(day)
+		})
+		return
+	}
+	for from.Before(until) {
+		sweepDay, err := d.sweepDayOnOrAfter(from)
+		if err != nil || !sweepDay.Before(until) || !f(sweepDay) {
+			return
+		}
+		from = sweepDay.AddDate(0, 0, 1)
+	}
+}
+
+// parseRRule parses an rrule day's rule, and its anchor in location as the rule's start if it has one.
+func (d Day) parseRRule(location *time.Location) (*rrule, time.Time, error) {
+	rule, err := parseRRule(d.RRule)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var start time.Time
+	if d.Anchor != "" {
+		start, err = time.ParseInLocation(anchorLayout, d.Anchor, location)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	}
+	return rule, start, nil
+}
+
+// daysBetween counts calendar days from a to b, ignoring any daylight savings change in between.
+func daysBetween(a, b time.Time) int {
+	aDate := time.Date(a.Year(), a.Month(), a.Day(), 0, 0, 0, 0, time.UTC)
+	bDate := time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, time.UTC)
+	return int(bDate.Sub(aDate).Hours() / 24)
+}
+
+// nthDayOfMonth returns midnight of the nth weekday of t's month. ok is false if the month doesn't have that day,
+// like a fifth Monday in a month with only four.
+func nthDayOfMonth(t time.Time, nthDay int, weekday int) (time.Time, bool) {
+	firstDayOfThisMonth := time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+	daysInMonth := firstDayOfThisMonth.AddDate(0, 1, -1).Day()
+	dateOfFirstWeekday := ((weekday+7)-int(firstDayOfThisMonth.Weekday()))%7 + 1
+	var dateOfNthWeekday int
+	if nthDay == lastWeek {
+		dateOfNthWeekday = dateOfFirstWeekday + ((daysInMonth-dateOfFirstWeekday)/7)*7
+	} else {
+		dateOfNthWeekday = dateOfFirstWeekday + ((nthDay - 1) * 7)
+	}
+	if dateOfNthWeekday > daysInMonth {
+		return time.Time{}, false
+	}
+	return time.Date(t.Year(), t.Month(), dateOfNthWeekday, 0, 0, 0, 0, t.Location()), true
+}
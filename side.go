@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// The sides of the street a schedule can be for. Schedules without a side are for the whole street, and their
+// reminders go out no matter which side someone is parked on.
+const (
+	sideOdd  = "odd"
+	sideEven = "even"
+)
+
+type parkedSide struct {
+	PhoneNumber string `json:"phoneNumber"`
+	Token       string `json:"token"`
+	Side        string `json:"side"`
+}
+
+func validSide(side string) bool {
+	return side == sideOdd || side == sideEven
+}
+
+func otherSide(side string) string {
+	if side == sideOdd {
+		return sideEven
+	}
+	return sideOdd
+}
+
+// remindsSide reports whether a schedule's reminders should go out to someone parked on the parked side. Until
+// someone tells us which side they are parked on, they get reminders for both.
+func remindsSide(scheduleSide, parked string) bool {
+	return scheduleSide == "" || parked == "" || scheduleSide == parked
+}
+
+// parkedSideHandler changes which side of the street someone is parked on, so that they only get reminders for
+// that side.
+func (env *Env) parkedSideHandler(w http.ResponseWriter, r *http.Request) {
+	decoder := json.NewDecoder(r.Body)
+	var t parkedSide
+	err := decoder.Decode(&t)
+	if err != nil {
+		log.Println("error decoding json: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "oops! we made a mistake")
+		return
+	}
+	defer r.Body.Close()
+
+	if !validSide(t.Side) {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, fmt.Sprintf("side must be %q or %q", sideOdd, sideEven))
+		return
+	}
+
+	verified, err := env.MsgSvc.VerifyCode(t.PhoneNumber, t.Token)
+	if err != nil || !verified {
+		log.Println("error verifying code: error: ", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, "validation code incorrect")
+		return
+	}
+
+	hasSides, err := env.Store.HasSideSchedules(t.PhoneNumber)
+	if err != nil {
+		log.Println("problem finding side schedules: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "oops! we made a mistake")
+		return
+	}
+	if !hasSides {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "none of your sweeping days have a side")
+		return
+	}
+
+	err = env.Store.SetParkedSide(t.PhoneNumber, t.Side)
+	if err != nil {
+		log.Println("problem saving parked side: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "oops! we made a mistake")
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// smsResponse is the TwiML that tells twilio what to text back to someone who texted us.
+type smsResponse struct {
+	XMLName xml.Name `xml:"Response"`
+	Message string   `xml:"Message"`
+}
+
+// incomingSMSHandler is twilio's webhook for texts people send us. Texting ODD or EVEN says which side of the street
+// you are parked on, SWITCH flips to the other side, and STOP removes all your alerts.
+func (env *Env) incomingSMSHandler(w http.ResponseWriter, r *http.Request) {
+	valid, err := env.MsgSvc.CheckRequest(r)
+	if err != nil || !valid {
+		log.Println("incoming sms failed signature check: ", err)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	phoneNumber := strings.TrimPrefix(r.PostForm.Get("From"), "+1")
+	body := r.PostForm.Get("Body")
+	var reply string
+	if isStopText(body) {
+		reply, err = env.handleStopText(phoneNumber, r.PostForm.Get("MessageSid"))
+	} else {
+		reply, err = env.handleSideText(phoneNumber, body)
+	}
+	if err != nil {
+		log.Println("problem handling incoming sms: ", err)
+		reply = "Sorry, something went wrong on our end. Please try again later."
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(smsResponse{Message: reply})
+}
+
+// handleSideText acts on a text from phoneNumber and returns what to text back.
+func (env *Env) handleSideText(phoneNumber, body string) (string, error) {
+	hasSides, err := env.Store.HasSideSchedules(phoneNumber)
+	if err != nil {
+		return "", err
+	}
+	if !hasSides {
+		return "You don't have any reminders that depend on which side of the street you park on.", nil
+	}
+
+	side := strings.ToLower(strings.TrimSpace(body))
+	switch side {
+	case sideOdd, sideEven:
+	case "switch", "flip":
+		current, err := env.Store.ParkedSide(phoneNumber)
+		if err != nil {
+			return "", err
+		}
+		side = otherSide(current)
+	default:
+		return "Text ODD or EVEN to tell us which side of the street you're parked on, or SWITCH to flip sides.", nil
+	}
+
+	err = env.Store.SetParkedSide(phoneNumber, side)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("Got it, you're parked on the %s side. We'll only remind you about %s side sweeping.", side, side), nil
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+)
+
+// snapshotVersion is the version of the snapshot format export writes. import reads this version and any older
+// ones; bump it whenever the format changes in a way older versions of import couldn't read.
+//
+// Version 2 added the consent ledger.
+const snapshotVersion = 2
+
+// snapshot is every subscriber and their schedules, and the consent ledger, in a form that doesn't depend on the
+// store they came from, for moving between databases or seeding one for local development. Removed schedules and
+// the delivery log aren't in it.
+type snapshot struct {
+	Version     int                  `json:"version"`
+	ExportedAt  int64                `json:"exportedAt"`
+	Subscribers []snapshotSubscriber `json:"subscribers"`
+	// Consents is everyone's consent ledger, without the IDs the store gave the events. It has the people who
+	// opted out and have no schedules any more too, since it's the proof we have to keep of when they did.
+	Consents []consentEvent `json:"consents"`
+}
+
+type snapshotSubscriber struct {
+	PhoneNumber string             `json:"phoneNumber"`
+	ParkedSide  string             `json:"parkedSide,omitempty"`
+	Schedules   []snapshotSchedule `json:"schedules"`
+}
+
+// snapshotSchedule is one of a subscriber's schedules. Its Day has no reminders; they are in Reminders, each with
+// its next call.
+type snapshotSchedule struct {
+	Timezone  string             `json:"timezone"`
+	Day       Day                `json:"day"`
+	Reminders []snapshotReminder `json:"reminders"`
+}
+
+type snapshotReminder struct {
+	Reminder
+	NextCall int64 `json:"nextCall"`
+}
+
+// takeSnapshot gathers every subscriber that has schedules, with their schedules, and the consent ledger from the
+// store.
+func (env *Env) takeSnapshot() (snapshot, error) {
+	snap := snapshot{Version: snapshotVersion, ExportedAt: Now().Unix(), Subscribers: []snapshotSubscriber{}, Consents: []consentEvent{}}
+	consents, err := env.Store.Consents("")
+	if err != nil {
+		return snap, err
+	}
+	for _, c := range consents {
+		c.ID = 0
+		snap.Consents = append(snap.Consents, c)
+	}
+
+	stored, err := env.Store.Reminders("", 0)
+	if err != nil {
+		return snap, err
+	}
+	sort.SliceStable(stored, func(i, j int) bool {
+		if stored[i].PhoneNumber != stored[j].PhoneNumber {
+			return stored[i].PhoneNumber < stored[j].PhoneNumber
+		}
+		if stored[i].ScheduleID != stored[j].ScheduleID {
+			return stored[i].ScheduleID < stored[j].ScheduleID
+		}
+		return stored[i].ID < stored[j].ID
+	})
+
+	var subscriber *snapshotSubscriber
+	lastSchedule := 0
+	for _, r := range stored {
+		if subscriber == nil || subscriber.PhoneNumber != r.PhoneNumber {
+			side, err := env.Store.ParkedSide(r.PhoneNumber)
+			if err != nil {
+				return snap, err
+			}
+			snap.Subscribers = append(snap.Subscribers, snapshotSubscriber{PhoneNumber: r.PhoneNumber, ParkedSide: side})
+			subscriber = &snap.Subscribers[len(snap.Subscribers)-1]
+		}
+		if r.ScheduleID != lastSchedule {
+			day := r.Day
+			day.Reminders = nil
+			subscriber.Schedules = append(subscriber.Schedules, snapshotSchedule{Timezone: r.Timezone, Day: day})
+			lastSchedule = r.ScheduleID
+		}
+		schedule := &subscriber.Schedules[len(subscriber.Schedules)-1]
+		schedule.Reminders = append(schedule.Reminders, snapshotReminder{Reminder: r.Reminder, NextCall: r.NextCall})
+	}
+	return snap, nil
+}
+
+// importSummary is what restoreSnapshot did.
+type importSummary struct {
+	Subscribers int
+	Schedules   int
+	// AlreadySaved is how many of the schedules were already saved, with the same day in the same timezone.
+	AlreadySaved int
+	Consents     int
+	// AlreadyRecorded is how many of the consent events were already in the ledger.
+	AlreadyRecorded int
+	// OptedOut is how many subscribers were skipped because their latest consent is an opt out.
+	OptedOut int
+}
+
+// snapshotAlert is the alert that saves sub's schedule sc.
+func snapshotAlert(sub snapshotSubscriber, sc snapshotSchedule) alert {
+	day := sc.Day
+	day.Reminders = nil
+	for _, r := range sc.Reminders {
+		day.Reminders = append(day.Reminders, r.Reminder)
+	}
+	a := alert{PhoneNumber: sub.PhoneNumber, Timezone: sc.Timezone, Times: []Day{day}}
+	// which side they are parked on only goes with schedules for a side, and validate refuses it for the others
+	if day.Side != "" {
+		a.ParkedSide = sub.ParkedSide
+	}
+	return a
+}
+
+// restoreSnapshot saves everything in snap. Schedules that are already saved get any reminders they don't have yet,
+// and only the reminders the import adds get the next call they have in the snapshot, so reminders that went out
+// since it was taken aren't sent again; a next call that has gone by is moved on to the next sweeping day, like
+// restoring a removed schedule does. Consent events already in the ledger aren't added again, so importing the same
+// snapshot again changes nothing. The consent ledger is imported first, and the schedules of anyone whose latest
+// consent is then an opt out are skipped, so an old snapshot doesn't sign up someone who has since opted out.
+//
+// Every schedule is checked like a signup, and every consent event checked too, before anything is saved, so a
+// snapshot with a bad one in it isn't half imported.
+func (env *Env) restoreSnapshot(snap snapshot) (importSummary, error) {
+	var summary importSummary
+	if snap.Version < 1 || snap.Version > snapshotVersion {
+		return summary, fmt.Errorf("can't import version %d snapshots, only up to version %d", snap.Version, snapshotVersion)
+	}
+	for i, sub := range snap.Subscribers {
+		for j, sc := range sub.Schedules {
+			err := snapshotAlert(sub, sc).validate()
+			if err != nil {
+				return summary, fmt.Errorf("subscriber %d, schedule %d: %v", i+1, j+1, err)
+			}
+		}
+	}
+	for i, c := range snap.Consents {
+		err := c.validate()
+		if err != nil {
+			return summary, fmt.Errorf("consent %d: %v", i+1, err)
+		}
+	}
+
+	// the events already in each phone number's ledger, without their IDs
+	recorded := map[string]map[consentEvent]bool{}
+	for _, c := range snap.Consents {
+		c.ID = 0
+		summary.Consents++
+		if recorded[c.PhoneNumber] == nil {
+			ledger, err := env.Store.Consents(c.PhoneNumber)
+			if err != nil {
+				return summary, fmt.Errorf("reading the consent ledger for %s: %v", c.PhoneNumber, err)
+			}
+			recorded[c.PhoneNumber] = map[consentEvent]bool{}
+			for _, l := range ledger {
+				l.ID = 0
+				recorded[c.PhoneNumber][l] = true
+			}
+		}
+		if recorded[c.PhoneNumber][c] {
+			summary.AlreadyRecorded++
+			continue
+		}
+		err := env.Store.RecordConsent(c)
+		if err != nil {
+			return summary, fmt.Errorf("recording consent for %s: %v", c.PhoneNumber, err)
+		}
+		recorded[c.PhoneNumber][c] = true
+	}
+
+	for _, sub := range snap.Subscribers {
+		optedOut, err := env.optedOut(sub.PhoneNumber)
+		if err != nil {
+			return summary, fmt.Errorf("reading the consent ledger for %s: %v", sub.PhoneNumber, err)
+		}
+		if optedOut {
+			summary.OptedOut++
+			continue
+		}
+		for _, sc := range sub.Schedules {
+			before, err := env.savedReminders(sub.PhoneNumber, sc)
+			if err != nil {
+				return summary, fmt.Errorf("reading the schedules of %s: %v", sub.PhoneNumber, err)
+			}
+			existing, err := env.Store.Save(snapshotAlert(sub, sc))
+			if err != nil {
+				return summary, fmt.Errorf("saving a schedule for %s: %v", sub.PhoneNumber, err)
+			}
+			summary.Schedules++
+			summary.AlreadySaved += len(existing)
+
+			err = env.restoreNextCalls(sub.PhoneNumber, sc, before)
+			if err != nil {
+				return summary, fmt.Errorf("saving next calls for %s: %v", sub.PhoneNumber, err)
+			}
+		}
+		summary.Subscribers++
+	}
+	return summary, nil
+}
+
+// savedReminders returns the saved reminders of phoneNumber's schedule for sc's day, or nil if they don't have one.
+func (env *Env) savedReminders(phoneNumber string, sc snapshotSchedule) ([]storedReminder, error) {
+	schedules, err := env.Store.Schedules(phoneNumber)
+	if err != nil {
+		return nil, err
+	}
+	key := sc.Day.key()
+	for _, saved := range schedules {
+		if saved.Timezone == sc.Timezone && saved.Day.key() == key {
+			return env.Store.Reminders("", saved.ID)
+		}
+	}
+	return nil, nil
+}
+
+// restoreNextCalls gives the reminders of phoneNumber's schedule for sc's day that aren't in before, which are the
+// ones the import just saved, the next calls they have in sc, or their next sweeping day's if those have gone by.
+func (env *Env) restoreNextCalls(phoneNumber string, sc snapshotSchedule, before []storedReminder) error {
+	stored, err := env.savedReminders(phoneNumber, sc)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return fmt.Errorf("the schedule wasn't saved")
+	}
+	saved := map[int]bool{}
+	for _, r := range before {
+		saved[r.ID] = true
+	}
+
+	now := Now().Unix()
+	var changes []nextCallChange
+	for _, r := range stored {
+		if saved[r.ID] {
+			continue
+		}
+		for _, want := range sc.Reminders {
+			if r.Reminder != want.Reminder {
+				continue
+			}
+			nextCall := want.NextCall
+			if nextCall <= now {
+				nextCall = restoredNextCall(r.Day, r.Reminder, r.Timezone)
+			}
+			if nextCall != r.NextCall {
+				changes = append(changes, nextCallChange{ReminderID: r.ID, ScheduleID: r.ScheduleID, Timezone: r.Timezone, Old: r.NextCall, New: nextCall})
+			}
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	// any that are skipped were moved on by FindReadyAlerts while importing, which is newer than the snapshot
+	_, err = env.Store.UpdateNextCalls(changes)
+	return err
+}
+
+// snapshotColumns are the columns of a CSV snapshot, which has a row for each reminder. The first row of the file
+// is the snapshot version and the second is these column names.
+var snapshotColumns = []string{"phone_number", "parked_side", "timezone", "kind", "nth_week", "weekday", "anchor", "rrule",
+	"season_start", "season_end", "start", "end", "side", "days_before", "time", "next_call"}
+
+// consentColumns are the columns of the consent ledger in a CSV snapshot. It comes after the reminders: a row with
+// just "consents", then a row of these column names, then a row for each event.
+var consentColumns = []string{"phone_number", "kind", "source", "disclosure_version", "ip_hash", "user_agent_hash", "request_id", "at"}
+
+func writeSnapshotCSV(w io.Writer, snap snapshot) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"version", strconv.Itoa(snap.Version)})
+	out.Write(snapshotColumns)
+	for _, sub := range snap.Subscribers {
+		for _, sc := range sub.Schedules {
+			var season Season
+			if sc.Day.Season != nil {
+				season = *sc.Day.Season
+			}
+			for _, r := range sc.Reminders {
+				out.Write([]string{sub.PhoneNumber, sub.ParkedSide, sc.Timezone, sc.Day.Kind, strconv.Itoa(sc.Day.NthWeek),
+					strconv.Itoa(sc.Day.Weekday), sc.Day.Anchor, sc.Day.RRule, season.Start, season.End, sc.Day.Start,
+					sc.Day.End, sc.Day.Side, strconv.Itoa(r.DaysBefore), r.Time, strconv.FormatInt(r.NextCall, 10)})
+			}
+		}
+	}
+	out.Write([]string{"consents"})
+	out.Write(consentColumns)
+	for _, c := range snap.Consents {
+		out.Write([]string{c.PhoneNumber, c.Kind, c.Source, c.DisclosureVersion, c.IPHash, c.UserAgentHash, c.RequestID, strconv.FormatInt(c.At, 10)})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func readSnapshotCSV(r io.Reader) (snapshot, error) {
+	var snap snapshot
+	in := csv.NewReader(r)
+	in.FieldsPerRecord = -1
+	records, err := in.ReadAll()
+	if err != nil {
+		return snap, err
+	}
+	if len(records) < 2 || len(records[0]) != 2 || records[0][0] != "version" {
+		return snap, fmt.Errorf("a CSV snapshot starts with its version, like version,%d", snapshotVersion)
+	}
+	snap.Version, err = strconv.Atoi(records[0][1])
+	if err != nil {
+		return snap, fmt.Errorf("bad snapshot version %q", records[0][1])
+	}
+
+	snap.Consents = []consentEvent{}
+	subscribers := map[string]int{}
+	for i, record := range records[2:] {
+		line := i + 3
+		if len(record) == 1 && record[0] == "consents" {
+			return snap, readConsentsCSV(&snap, records[i+3:], line+1)
+		}
+		if len(record) != len(snapshotColumns) {
+			return snap, fmt.Errorf("line %d has %d columns, it should have %d", line, len(record), len(snapshotColumns))
+		}
+		var numbers [4]int64
+		for j, column := range []int{4, 5, 13, 15} {
+			numbers[j], err = strconv.ParseInt(record[column], 10, 64)
+			if err != nil {
+				return snap, fmt.Errorf("line %d: %s must be a number, got %q", line, snapshotColumns[column], record[column])
+			}
+		}
+		day := Day{Kind: record[3], NthWeek: int(numbers[0]), Weekday: int(numbers[1]), Anchor: record[6], RRule: record[7],
+			Start: record[10], End: record[11], Side: record[12]}
+		if record[8] != "" {
+			day.Season = &Season{Start: record[8], End: record[9]}
+		}
+		reminder := snapshotReminder{Reminder: Reminder{DaysBefore: int(numbers[2]), Time: record[14]}, NextCall: numbers[3]}
+
+		phoneNumber, timezone := record[0], record[2]
+		row := snapshotSchedule{Timezone: timezone, Day: day, Reminders: []snapshotReminder{reminder}}
+		err = snapshotAlert(snapshotSubscriber{PhoneNumber: phoneNumber, ParkedSide: record[1]}, row).validate()
+		if err != nil {
+			return snap, fmt.Errorf("line %d: %v", line, err)
+		}
+		n, ok := subscribers[phoneNumber]
+		if !ok {
+			n = len(snap.Subscribers)
+			subscribers[phoneNumber] = n
+			snap.Subscribers = append(snap.Subscribers, snapshotSubscriber{PhoneNumber: phoneNumber, ParkedSide: record[1]})
+		}
+		sub := &snap.Subscribers[n]
+		key := day.key()
+		found := false
+		for k := range sub.Schedules {
+			if sub.Schedules[k].Timezone == timezone && sub.Schedules[k].Day.key() == key {
+				sub.Schedules[k].Reminders = append(sub.Schedules[k].Reminders, reminder)
+				found = true
+				break
+			}
+		}
+		if !found {
+			sub.Schedules = append(sub.Schedules, snapshotSchedule{Timezone: timezone, Day: day, Reminders: []snapshotReminder{reminder}})
+		}
+	}
+	return snap, nil
+}
+
+// readConsentsCSV reads the consent ledger of a CSV snapshot into snap. records starts with its column names, which
+// are on line firstLine.
+func readConsentsCSV(snap *snapshot, records [][]string, firstLine int) error {
+	if len(records) == 0 || len(records[0]) != len(consentColumns) || records[0][0] != consentColumns[0] {
+		return fmt.Errorf("line %d should have the consent column names", firstLine)
+	}
+	for i, record := range records[1:] {
+		line := firstLine + i + 1
+		if len(record) != len(consentColumns) {
+			return fmt.Errorf("line %d has %d columns, it should have %d", line, len(record), len(consentColumns))
+		}
+		at, err := strconv.ParseInt(record[7], 10, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: at must be a number, got %q", line, record[7])
+		}
+		c := consentEvent{PhoneNumber: record[0], Kind: record[1], Source: record[2], DisclosureVersion: record[3], IPHash: record[4],
+			UserAgentHash: record[5], RequestID: record[6], At: at}
+		err = c.validate()
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		snap.Consents = append(snap.Consents, c)
+	}
+	return nil
+}
+
+// snapshotFlags parses the flags export and import share: -file, which is - for stdout or stdin, and -format, which
+// is json or csv and is worked out from the file's extension if it isn't given.
+func snapshotFlags(name string, args []string) (file, format string, err error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&file, "file", "-", "the snapshot file, or - for standard output or input")
+	flags.StringVar(&format, "format", "", "json or csv; by default, the file's extension, or json")
+	err = flags.Parse(args)
+	if err != nil {
+		return "", "", err
+	}
+	if format == "" {
+		format = "json"
+		if filepath.Ext(file) == ".csv" {
+			format = "csv"
+		}
+	}
+	if format != "json" && format != "csv" {
+		return "", "", fmt.Errorf("-format must be json or csv, got %q", format)
+	}
+	return file, format, nil
+}
+
+// exportCommand writes a snapshot of every subscriber and schedule.
+func exportCommand(env *Env, args []string) error {
+	file, format, err := snapshotFlags("export", args)
+	if err != nil {
+		return err
+	}
+	snap, err := env.takeSnapshot()
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if file != "-" {
+		w, err = os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	if format == "csv" {
+		err = writeSnapshotCSV(w, snap)
+	} else {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(snap)
+	}
+	if err != nil {
+		return err
+	}
+	if file != "-" {
+		fmt.Printf("exported %d subscribers to %s\n", len(snap.Subscribers), file)
+	}
+	return nil
+}
+
+// importCommand saves everything in a snapshot that export wrote.
+func importCommand(env *Env, args []string) error {
+	file, format, err := snapshotFlags("import", args)
+	if err != nil {
+		return err
+	}
+
+	r := os.Stdin
+	if file != "-" {
+		r, err = os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+	}
+	var snap snapshot
+	if format == "csv" {
+		snap, err = readSnapshotCSV(r)
+	} else {
+		err = json.NewDecoder(r).Decode(&snap)
+	}
+	if err != nil {
+		return fmt.Errorf("reading the snapshot: %v", err)
+	}
+
+	summary, err := env.restoreSnapshot(snap)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d schedules for %d subscribers, %d of them already saved\n", summary.Schedules, summary.Subscribers, summary.AlreadySaved)
+	fmt.Printf("imported %d consent events, %d of them already recorded\n", summary.Consents, summary.AlreadyRecorded)
+	if summary.OptedOut > 0 {
+		fmt.Printf("skipped the schedules of %d subscribers who have opted out\n", summary.OptedOut)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"time"
+)
+
+// AlertStore is where subscribers, their schedules, the schedules' reminders and everything we keep track of about
+// them are saved. The app uses MySQL or postgres in production, and the tests use a store that keeps everything in
+// memory.
+type AlertStore interface {
+	// Save saves an alert, with one saved schedule for each of its days. It adds a subscriber for the alert's phone
+	// number if there isn't one yet. Days the subscriber already has a schedule for in the same timezone keep that
+	// schedule and only get the reminders it doesn't have yet; existing has their indexes in a.Times.
+	Save(a alert) (existing []int, err error)
+	// Remove marks all of phoneNumber's schedules removed, and forgets which side they are parked on. Removed
+	// schedules stay saved, for the audit trail and so they can be restored, but are otherwise left out of
+	// everything until PurgeRemoved deletes them.
+	Remove(phoneNumber string, why removal) error
+	// Schedules returns phoneNumber's schedules that haven't been removed, each day with its reminders, oldest first.
+	Schedules(phoneNumber string) ([]storedSchedule, error)
+	// RemoveSchedule marks one of phoneNumber's schedules removed. It reports false if phoneNumber doesn't have a
+	// schedule with that ID that hasn't been removed already.
+	RemoveSchedule(phoneNumber string, scheduleID int, why removal) (bool, error)
+	// RemovedSchedules returns phoneNumber's removed schedules, oldest first, with why they were removed.
+	RemovedSchedules(phoneNumber string) ([]storedSchedule, error)
+	// Restore undoes the removal of phoneNumber's schedule with ID scheduleID, or of all of their removed schedules
+	// if it is 0, and returns the IDs of the ones it restored. A removed schedule for a day they have signed up for
+	// again isn't restored. Reminders whose next call went by while they were removed are moved on to their next
+	// sweeping day in the same transaction, so that FindReadyAlerts never finds them due; the others keep theirs.
+	Restore(phoneNumber string, scheduleID int) ([]int, error)
+	// PurgeRemoved deletes the schedules that were removed before before, along with their reminders and the
+	// subscribers whose last schedules they were, and returns how many schedules it deleted. Subscribers who never had
+	// a schedule, like someone who has only texted which side they parked on, are kept.
+	PurgeRemoved(before int64) (int, error)
+	// Forget deletes everything saved about phoneNumber, for when they ask us to: their schedules, removed ones
+	// included, and reminders, which side they are parked on, their late reminders and their delivery log. Their
+	// consent ledger is kept, as the proof we have to keep of when they opted in and out.
+	Forget(phoneNumber string) error
+
+	// DueReminders returns the reminders whose NextCall is before now.
+	DueReminders(now int64) ([]storedReminder, error)
+	// Reminders returns every saved reminder, or just the ones for schedules in timezone or for the schedule with ID
+	// scheduleID when those aren't empty.
+	Reminders(timezone string, scheduleID int) ([]storedReminder, error)
+	// UpdateNextCalls saves the new NextCall of each changed reminder, all together or not at all. A reminder whose
+	// NextCall isn't Old any more, because something else moved it on since it was read, is left alone, and its
+	// change is returned as skipped.
+	UpdateNextCalls(changes []nextCallChange) (skipped []nextCallChange, err error)
+
+	RecordLateReminder(l lateReminder) error
+	// LateReminders returns the reminders due from since up to until that were sent late or skipped.
+	LateReminders(since, until time.Time) ([]lateReminder, error)
+
+	// RecordMessage adds a text we sent, or tried to, to the delivery log.
+	RecordMessage(m sentMessage) error
+	// Messages returns up to limit of the texts in the delivery log for phoneNumber, or for everyone if it is "",
+	// newest first. If before isn't 0, it starts with the one before the message with that ID.
+	Messages(phoneNumber string, before, limit int) ([]sentMessage, error)
+	// PurgeMessages deletes the texts in the delivery log sent before before, and returns how many it deleted.
+	PurgeMessages(before int64) (int, error)
+	// UndeliverableSubscribers returns the phone numbers whose last failures texts for schedules that haven't been
+	// removed all couldn't be delivered.
+	UndeliverableSubscribers(failures int) ([]string, error)
+
+	// RecordConsent adds an event to the consent ledger.
+	RecordConsent(c consentEvent) error
+	// Consents returns phoneNumber's consent ledger, oldest first, or everyone's if phoneNumber is empty.
+	Consents(phoneNumber string) ([]consentEvent, error)
+
+	SetParkedSide(phoneNumber, side string) error
+	// ParkedSide returns the side of the street phoneNumber is parked on, or "" if they haven't said.
+	ParkedSide(phoneNumber string) (string, error)
+	// HasSideSchedules reports whether phoneNumber has any schedules for just one side of the street.
+	HasSideSchedules(phoneNumber string) (bool, error)
+}
+
+// storedReminder is a saved reminder along with the schedule it belongs to.
+type storedReminder struct {
+	ID          int
+	ScheduleID  int
+	PhoneNumber string
+	Timezone    string
+	Day         Day
+	Reminder    Reminder
+	NextCall    int64
+
+	// ParkedSide is the side of the street PhoneNumber is parked on. Only DueReminders fills it in.
+	ParkedSide string
+}
+
+// storedSchedule is one of a subscriber's saved days. NextCall is the soonest of its reminders' next calls.
+type storedSchedule struct {
+	ID       int    `json:"id"`
+	Timezone string `json:"timezone"`
+	Day      Day    `json:"day"`
+	NextCall int64  `json:"nextCall"`
+
+	// Removed says why the schedule was removed, and is nil if it hasn't been.
+	Removed *removal `json:"removed,omitempty"`
+}
+
+// scheduledDay is one of an alert's days with its next calls worked out, ready to be saved. NextCalls has the next
+// call of each of Day.reminders(), in the same order, and NextCall is the soonest of them.
+type scheduledDay struct {
+	Day       Day
+	NextCall  int64
+	NextCalls []int64
+}
+
+// key identifies which days a Day sweeps on, and when, whatever its reminders are. A subscriber has at most one
+// schedule for each key in a timezone.
+func (d Day) key() string {
+	var season Season
+	if d.Season != nil {
+		season = *d.Season
+	}
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%d|%d|%s|%s|%s|%s|%s|%s|%s",
+		d.kind(), d.NthWeek, d.Weekday, d.Anchor, d.RRule, season.Start, season.End, d.Start, d.End, d.Side)))
+	return hex.EncodeToString(sum[:])
+}
+
+// restoredNextCall is the next call of a reminder whose next call went by while its schedule was removed: its next
+// sweeping day from now, or math.MaxInt64 if it doesn't have any more, like recompute.
+func restoredNextCall(d Day, r Reminder, timezone string) int64 {
+	nextCall, err := calculateReminderCall(d, r, timezone)
+	if err != nil {
+		return math.MaxInt64
+	}
+	return nextCall
+}
+
+// scheduleDays works out when each of an alert's reminders should first go out.
+func scheduleDays(a alert) ([]scheduledDay, error) {
+	var scheduled []scheduledDay
+	for _, d := range a.days() {
+		d.Kind = d.kind()
+		nextCall, err := CalculateNextCall(d, a.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		s := scheduledDay{Day: d, NextCall: nextCall}
+		for _, r := range d.reminders() {
+			reminderNextCall, err := calculateReminderCall(d, r, a.Timezone)
+			if err != nil {
+				return nil, err
+			}
+			s.NextCalls = append(s.NextCalls, reminderNextCall)
+		}
+		scheduled = append(scheduled, s)
+	}
+	return scheduled, nil
+}
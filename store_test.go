@@ -0,0 +1,1116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// The store conformance suite runs against every AlertStore, so that they all behave the same. The memory store
+// always runs; the SQL stores run when STREETSWEEP_TEST_MYSQL_URL or STREETSWEEP_TEST_POSTGRES_URL point at a
+// database they can empty out.
+var _ = Describe("AlertStore", func() {
+	describeAlertStore("memory", func() AlertStore {
+		return NewMemoryStore()
+	})
+	describeAlertStore("mysql", sqlTestStore("STREETSWEEP_TEST_MYSQL_URL"))
+	describeAlertStore("postgres", sqlTestStore("STREETSWEEP_TEST_POSTGRES_URL"))
+})
+
+// sqlTestStore returns a function that opens the test database in the environment variable urlVariable, migrates
+// it and empties it, or nil if the variable isn't set.
+func sqlTestStore(urlVariable string) func() AlertStore {
+	url := os.Getenv(urlVariable)
+	if url == "" {
+		return nil
+	}
+	return func() AlertStore {
+		if phoneKeys == nil {
+			phoneKeys = testPhoneKeys("test")
+		}
+		store, err := openSQLStore(url)
+		Expect(err).NotTo(HaveOccurred())
+		err = store.migrateUp(migrations[len(migrations)-1].Version)
+		Expect(err).NotTo(HaveOccurred())
+		for _, table := range []string{"consents", "messages", "late_reminders", "reminders", "schedules", "subscribers"} {
+			_, err = store.db.Exec("DELETE FROM " + table)
+			Expect(err).NotTo(HaveOccurred())
+		}
+		return store
+	}
+}
+
+var _ = Describe("migrations", func() {
+	describeMigrations("mysql", "STREETSWEEP_TEST_MYSQL_URL")
+	describeMigrations("postgres", "STREETSWEEP_TEST_POSTGRES_URL")
+})
+
+// describeMigrations runs the migration specs against the test database in the environment variable urlVariable.
+// They drop every table in it.
+func describeMigrations(name, urlVariable string) {
+	Describe(name, func() {
+		It("should bring a database from before the migrations up to date", func() {
+			url := os.Getenv(urlVariable)
+			if url == "" {
+				Skip("no test database for " + name)
+			}
+			if phoneKeys == nil {
+				phoneKeys = testPhoneKeys("test")
+			}
+			store, err := openSQLStore(url)
+			Expect(err).NotTo(HaveOccurred())
+			for _, table := range []string{"consents", "messages", "late_reminders", "reminders", "schedules", "subscribers", "parked_sides", "alerts", "schema_migrations"} {
+				_, err = store.db.Exec("DROP TABLE IF EXISTS " + table + " CASCADE")
+				Expect(err).NotTo(HaveOccurred())
+			}
+
+			// the alerts table as the app first created it, with an alert in it
+			_, err = store.db.Exec(baselineTable(store.dialect, "alerts"))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = store.db.Exec(store.dialect.rebind("INSERT INTO alerts (PHONE_NUMBER, NTH_DAY, TIMEZONE, WEEKDAY, NEXT_CALL) VALUES (?,?,?,?,?)"),
+				"1234567890", 1, "America/New_York", "0", 1500000000)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(store.migrateUp(migrations[len(migrations)-1].Version)).To(Succeed())
+
+			schedules, err := store.Schedules("1234567890")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedules).To(HaveLen(1))
+			Expect(schedules[0].Timezone).To(Equal("America/New_York"))
+			Expect(schedules[0].Day.Kind).To(Equal(kindMonthly))
+			Expect(schedules[0].Day.NthWeek).To(Equal(1))
+			Expect(schedules[0].Day.Weekday).To(Equal(0))
+			Expect(schedules[0].Day.Reminders).To(Equal([]Reminder{defaultReminder}))
+			stored, err := store.Reminders("", schedules[0].ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored).To(HaveLen(1))
+			Expect(stored[0].NextCall).To(Equal(int64(1500000000)))
+
+			tx, err := store.db.Begin()
+			Expect(err).NotTo(HaveOccurred())
+			defer tx.Rollback()
+			for table, index := range map[string]string{"late_reminders": "late_reminders_phone_index", "messages": "messages_phone_index"} {
+				Expect(indexExists(tx, store.dialect, table, index)).To(BeTrue(), table)
+			}
+		})
+	})
+}
+
+// testPhoneKeys returns phone number keys with the given key IDs, newest first. A key ID always gets the same key,
+// and there is only one index key.
+func testPhoneKeys(ids ...string) *phoneNumberKeys {
+	var keys []string
+	for _, id := range ids {
+		keys = append(keys, id+":"+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte(id[:1]), 32)))
+	}
+	k, err := parsePhoneKeys(strings.Join(keys, ","), base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{'i'}, 32)))
+	Expect(err).NotTo(HaveOccurred())
+	return k
+}
+
+var _ = Describe("phone number keys", func() {
+	It("should decrypt what it encrypts, without saving the phone number in the clear", func() {
+		k := testPhoneKeys("a")
+		encrypted, err := k.encrypt("1234567890")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(encrypted).To(HavePrefix("a:"))
+		Expect(encrypted).NotTo(ContainSubstring("1234567890"))
+
+		again, err := k.encrypt("1234567890")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again).NotTo(Equal(encrypted))
+
+		Expect(k.decrypt(encrypted)).To(Equal("1234567890"))
+	})
+
+	It("should give a phone number the same index whichever key is current", func() {
+		old, rotated := testPhoneKeys("a"), testPhoneKeys("b", "a")
+		Expect(old.index("1234567890")).To(Equal(rotated.index("1234567890")))
+		Expect(old.index("1234567890")).NotTo(Equal(old.index("5555555555")))
+		Expect(old.index("1234567890")).NotTo(ContainSubstring("1234567890"))
+	})
+
+	It("should decrypt phone numbers encrypted with an old key after rotating", func() {
+		encrypted, err := testPhoneKeys("a").encrypt("1234567890")
+		Expect(err).NotTo(HaveOccurred())
+
+		rotated := testPhoneKeys("b", "a")
+		Expect(rotated.encryptedWithCurrent(encrypted)).To(BeFalse())
+		Expect(rotated.decrypt(encrypted)).To(Equal("1234567890"))
+
+		_, err = testPhoneKeys("b").decrypt(encrypted)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should refuse keys that aren't the right length", func() {
+		_, err := parsePhoneKeys("a:"+base64.StdEncoding.EncodeToString([]byte("short")), base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{'i'}, 32)))
+		Expect(err).To(HaveOccurred())
+		_, err = parsePhoneKeys("a:"+base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32)), "")
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+func describeAlertStore(name string, newStore func() AlertStore) {
+	Describe(name, func() {
+		var store AlertStore
+
+		BeforeEach(func() {
+			if newStore == nil {
+				Skip("no test database for " + name)
+			}
+			store = newStore()
+		})
+
+		weekly := alert{
+			Timezone: "America/Los_Angeles",
+			Times: []Day{
+				{Kind: kindWeekly, Weekday: 2, Start: "08:00", End: "10:00", Side: sideOdd, Season: &Season{Start: "04-01", End: "11-30"}},
+			},
+			Reminders:   []Reminder{{DaysBefore: 1, Time: "19:00"}, {DaysBefore: 0, Time: "07:00"}},
+			ParkedSide:  sideOdd,
+			PhoneNumber: "1234567890",
+		}
+		monthly := alert{
+			Timezone:    "America/New_York",
+			Times:       []Day{{NthWeek: 1, Weekday: 0}},
+			PhoneNumber: "5555555555",
+		}
+
+		It("should give back each saved reminder with its schedule and next call", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+
+			stored, err := store.Reminders("", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored).To(HaveLen(2))
+
+			day := weekly.Times[0]
+			for i, r := range weekly.Reminders {
+				nextCall, err := calculateReminderCall(day, r, weekly.Timezone)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(stored[i].ScheduleID).To(Equal(stored[0].ScheduleID))
+				Expect(stored[i].PhoneNumber).To(Equal(weekly.PhoneNumber))
+				Expect(stored[i].Timezone).To(Equal(weekly.Timezone))
+				Expect(stored[i].Day).To(Equal(day))
+				Expect(stored[i].Reminder).To(Equal(r))
+				Expect(stored[i].NextCall).To(Equal(nextCall))
+			}
+			Expect(stored[0].ID).NotTo(Equal(stored[1].ID))
+		})
+
+		It("should save monthly days as monthly", func() {
+			Expect(store.Save(monthly)).To(BeEmpty())
+
+			stored, err := store.Reminders("", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored).To(HaveLen(1))
+			Expect(stored[0].Day.Kind).To(Equal(kindMonthly))
+			Expect(stored[0].Day.Season).To(BeNil())
+			Expect(stored[0].Reminder).To(Equal(defaultReminder))
+		})
+
+		It("should keep one schedule when the same day is saved again", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			stored, err := store.Reminders("", 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			again := weekly
+			again.Times = []Day{{NthWeek: 3, Weekday: 5}, weekly.Times[0]}
+			again.Reminders = append([]Reminder{{DaysBefore: 2, Time: "12:00"}}, weekly.Reminders...)
+			Expect(store.Save(again)).To(Equal([]int{1}))
+
+			schedules, err := store.Schedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedules).To(HaveLen(2))
+			Expect(schedules[0].ID).To(Equal(stored[0].ScheduleID))
+			Expect(schedules[0].Day.Reminders).To(ConsistOf(again.Reminders))
+			Expect(schedules[1].Day.Reminders).To(Equal(again.Reminders))
+
+			// the reminders it already had are left as they were
+			updated, err := store.Reminders("", stored[0].ScheduleID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated).To(HaveLen(3))
+			Expect(updated[0]).To(Equal(stored[0]))
+			Expect(updated[1]).To(Equal(stored[1]))
+		})
+
+		It("should not count a day in another timezone as saved already", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			elsewhere := weekly
+			elsewhere.Timezone = "America/Chicago"
+			Expect(store.Save(elsewhere)).To(BeEmpty())
+
+			schedules, err := store.Schedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedules).To(HaveLen(2))
+		})
+
+		It("should filter reminders by timezone and alert", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			Expect(store.Save(monthly)).To(BeEmpty())
+
+			stored, err := store.Reminders("America/New_York", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored).To(HaveLen(1))
+			Expect(stored[0].PhoneNumber).To(Equal(monthly.PhoneNumber))
+
+			stored, err = store.Reminders("", stored[0].ScheduleID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored).To(HaveLen(1))
+			Expect(stored[0].PhoneNumber).To(Equal(monthly.PhoneNumber))
+
+			stored, err = store.Reminders("America/Chicago", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored).To(BeEmpty())
+		})
+
+		It("should find due reminders with the side their owner is parked on", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			Expect(store.Save(monthly)).To(BeEmpty())
+			stored, err := store.Reminders("", 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			due, err := store.DueReminders(stored[0].NextCall)
+			Expect(err).NotTo(HaveOccurred())
+			for _, r := range due {
+				Expect(r.NextCall).To(BeNumerically("<", stored[0].NextCall))
+			}
+
+			due, err = store.DueReminders(stored[0].NextCall + 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(due).NotTo(BeEmpty())
+			found := false
+			for _, r := range due {
+				if r.ID == stored[0].ID {
+					found = true
+					Expect(r.ParkedSide).To(Equal(sideOdd))
+				}
+			}
+			Expect(found).To(BeTrue())
+		})
+
+		It("should update next calls", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			stored, err := store.Reminders("", 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			skipped, err := store.UpdateNextCalls([]nextCallChange{{ReminderID: stored[1].ID, ScheduleID: stored[1].ScheduleID, Old: stored[1].NextCall, New: 42}})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(skipped).To(BeEmpty())
+
+			updated, err := store.Reminders("", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated[0].NextCall).To(Equal(stored[0].NextCall))
+			Expect(updated[1].NextCall).To(Equal(int64(42)))
+		})
+
+		It("should leave next calls that changed since they were read alone", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			stored, err := store.Reminders("", 0)
+			Expect(err).NotTo(HaveOccurred())
+
+			stale := nextCallChange{ReminderID: stored[0].ID, ScheduleID: stored[0].ScheduleID, Old: stored[0].NextCall - 1, New: 42}
+			fresh := nextCallChange{ReminderID: stored[1].ID, ScheduleID: stored[1].ScheduleID, Old: stored[1].NextCall, New: 43}
+			skipped, err := store.UpdateNextCalls([]nextCallChange{stale, fresh})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(skipped).To(Equal([]nextCallChange{stale}))
+
+			updated, err := store.Reminders("", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(updated[0].NextCall).To(Equal(stored[0].NextCall))
+			Expect(updated[1].NextCall).To(Equal(int64(43)))
+		})
+
+		It("should keep track of which side people are parked on", func() {
+			side, err := store.ParkedSide(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(side).To(Equal(""))
+
+			Expect(store.Save(weekly)).To(BeEmpty())
+			side, err = store.ParkedSide(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(side).To(Equal(sideOdd))
+
+			Expect(store.SetParkedSide(weekly.PhoneNumber, sideEven)).To(Succeed())
+			side, err = store.ParkedSide(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(side).To(Equal(sideEven))
+		})
+
+		It("should know who has schedules for one side of the street", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			Expect(store.Save(monthly)).To(BeEmpty())
+
+			hasSides, err := store.HasSideSchedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hasSides).To(BeTrue())
+
+			hasSides, err = store.HasSideSchedules(monthly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hasSides).To(BeFalse())
+		})
+
+		It("should remove everything for a phone number and nothing else", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			Expect(store.Save(monthly)).To(BeEmpty())
+
+			Expect(store.Remove(weekly.PhoneNumber, removal{At: 1500000000, Reason: removedOnWeb, RequestID: "req-1"})).To(Succeed())
+
+			stored, err := store.Reminders("", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored).To(HaveLen(1))
+			Expect(stored[0].PhoneNumber).To(Equal(monthly.PhoneNumber))
+
+			side, err := store.ParkedSide(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(side).To(Equal(""))
+
+			due, err := store.DueReminders(math.MaxInt64)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(due).To(HaveLen(1))
+			Expect(due[0].PhoneNumber).To(Equal(monthly.PhoneNumber))
+
+			hasSides, err := store.HasSideSchedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hasSides).To(BeFalse())
+		})
+
+		It("should keep removed schedules with why they were removed", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			schedules, err := store.Schedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+
+			why := removal{At: 1500000000, Reason: removedBySMS, RequestID: "SM123"}
+			Expect(store.Remove(weekly.PhoneNumber, why)).To(Succeed())
+
+			left, err := store.Schedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(left).To(BeEmpty())
+
+			removed, err := store.RemovedSchedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removed).To(HaveLen(1))
+			Expect(removed[0].ID).To(Equal(schedules[0].ID))
+			Expect(removed[0].Day).To(Equal(schedules[0].Day))
+			Expect(removed[0].Removed).To(Equal(&why))
+		})
+
+		It("should save a removed day again as a new schedule", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			Expect(store.Remove(weekly.PhoneNumber, removal{At: 1500000000, Reason: removedOnWeb})).To(Succeed())
+
+			Expect(store.Save(weekly)).To(BeEmpty())
+			schedules, err := store.Schedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedules).To(HaveLen(1))
+			removed, err := store.RemovedSchedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removed).To(HaveLen(1))
+			Expect(removed[0].ID).NotTo(Equal(schedules[0].ID))
+
+			// it's already back, so there's nothing to restore
+			restored, err := store.Restore(weekly.PhoneNumber, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(BeEmpty())
+		})
+
+		It("should let a day be removed, saved and removed again in the same second", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			why := removal{At: 1500000000, Reason: removedOnWeb}
+			Expect(store.Remove(weekly.PhoneNumber, why)).To(Succeed())
+			Expect(store.Save(weekly)).To(BeEmpty())
+			Expect(store.Remove(weekly.PhoneNumber, why)).To(Succeed())
+			Expect(store.Save(weekly)).To(BeEmpty())
+			schedules, err := store.Schedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedules).To(HaveLen(1))
+			Expect(store.RemoveSchedule(weekly.PhoneNumber, schedules[0].ID, why)).To(BeTrue())
+
+			removed, err := store.RemovedSchedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removed).To(HaveLen(3))
+		})
+
+		It("should restore removed schedules", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			Expect(store.Save(monthly)).To(BeEmpty())
+			// a next call that went by while the schedule was removed
+			saved, err := store.Reminders("", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(store.UpdateNextCalls([]nextCallChange{{ReminderID: saved[0].ID, ScheduleID: saved[0].ScheduleID, Old: saved[0].NextCall, New: 42}})).To(BeEmpty())
+			Expect(store.Remove(weekly.PhoneNumber, removal{At: 1500000000, Reason: removedByAdmin})).To(Succeed())
+			removed, err := store.RemovedSchedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+
+			restored, err := store.Restore(monthly.PhoneNumber, removed[0].ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(BeEmpty())
+
+			restored, err = store.Restore(weekly.PhoneNumber, removed[0].ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(restored).To(Equal([]int{removed[0].ID}))
+
+			schedules, err := store.Schedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedules).To(HaveLen(1))
+			Expect(schedules[0].Removed).To(BeNil())
+			stored, err := store.Reminders("", removed[0].ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored).To(HaveLen(2))
+			Expect(stored[0].NextCall).To(Equal(saved[0].NextCall))
+			Expect(stored[1].NextCall).To(Equal(saved[1].NextCall))
+			soonest := saved[0].NextCall
+			if saved[1].NextCall < soonest {
+				soonest = saved[1].NextCall
+			}
+			Expect(schedules[0].NextCall).To(Equal(soonest))
+		})
+
+		It("should purge schedules that were removed before the cutoff", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			Expect(store.Save(monthly)).To(BeEmpty())
+			Expect(store.Remove(weekly.PhoneNumber, removal{At: 1500000000, Reason: removedOnWeb})).To(Succeed())
+			Expect(store.Remove(monthly.PhoneNumber, removal{At: 1600000000, Reason: removedOnWeb})).To(Succeed())
+
+			purged, err := store.PurgeRemoved(1500000001)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(purged).To(Equal(1))
+
+			removed, err := store.RemovedSchedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removed).To(BeEmpty())
+			removed, err = store.RemovedSchedules(monthly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removed).To(HaveLen(1))
+		})
+
+		It("should only purge the subscribers whose last schedules it purged", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			Expect(store.Remove(weekly.PhoneNumber, removal{At: 1500000000, Reason: removedOnWeb})).To(Succeed())
+			Expect(store.SetParkedSide(weekly.PhoneNumber, sideOdd)).To(Succeed())
+			// someone who has only texted which side they parked on
+			Expect(store.SetParkedSide("2223334444", sideEven)).To(Succeed())
+
+			Expect(store.PurgeRemoved(1500000001)).To(Equal(1))
+			Expect(store.ParkedSide(weekly.PhoneNumber)).To(BeEmpty())
+			Expect(store.ParkedSide("2223334444")).To(Equal(sideEven))
+		})
+
+		It("should give back a phone number's schedules with their reminders", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			Expect(store.Save(monthly)).To(BeEmpty())
+
+			schedules, err := store.Schedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedules).To(HaveLen(1))
+			Expect(schedules[0].Timezone).To(Equal(weekly.Timezone))
+			Expect(schedules[0].Day.Side).To(Equal(sideOdd))
+			Expect(schedules[0].Day.Season).To(Equal(weekly.Times[0].Season))
+			Expect(schedules[0].Day.Reminders).To(Equal(weekly.Reminders))
+
+			stored, err := store.Reminders("", schedules[0].ID)
+			Expect(err).NotTo(HaveOccurred())
+			soonest := stored[0].NextCall
+			if stored[1].NextCall < soonest {
+				soonest = stored[1].NextCall
+			}
+			Expect(schedules[0].NextCall).To(Equal(soonest))
+
+			schedules, err = store.Schedules("0000000000")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedules).To(BeEmpty())
+		})
+
+		It("should remove one schedule, but only for its own phone number", func() {
+			Expect(store.Save(alert{
+				Timezone:    weekly.Timezone,
+				Times:       []Day{weekly.Times[0], {NthWeek: 2, Weekday: 4}},
+				PhoneNumber: weekly.PhoneNumber,
+			})).To(BeEmpty())
+			schedules, err := store.Schedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(schedules).To(HaveLen(2))
+
+			why := removal{At: 1500000000, Reason: removedOnWeb, RequestID: "req-1"}
+			removed, err := store.RemoveSchedule(monthly.PhoneNumber, schedules[0].ID, why)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removed).To(BeFalse())
+
+			removed, err = store.RemoveSchedule(weekly.PhoneNumber, schedules[0].ID, why)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removed).To(BeTrue())
+
+			left, err := store.Schedules(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(left).To(HaveLen(1))
+			Expect(left[0].ID).To(Equal(schedules[1].ID))
+
+			stored, err := store.Reminders("", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored).To(HaveLen(1))
+			Expect(stored[0].ScheduleID).To(Equal(schedules[1].ID))
+
+			removed, err = store.RemoveSchedule(weekly.PhoneNumber, schedules[0].ID, why)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(removed).To(BeFalse())
+		})
+
+		It("should page through the delivery log, newest first", func() {
+			for i := 0; i < 3; i++ {
+				Expect(store.RecordMessage(sentMessage{PhoneNumber: weekly.PhoneNumber, ScheduleID: 1, ReminderID: 2, Body: "reminder", ProviderID: "SM1", Status: messageSent, DueAt: int64(i), SentAt: int64(i + 1)})).To(Succeed())
+			}
+			Expect(store.RecordMessage(sentMessage{PhoneNumber: monthly.PhoneNumber, Body: "other", Status: messageFailed})).To(Succeed())
+
+			page, err := store.Messages(weekly.PhoneNumber, 0, 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page).To(HaveLen(2))
+			Expect(page[0].DueAt).To(Equal(int64(2)))
+			Expect(page[1].DueAt).To(Equal(int64(1)))
+			Expect(page[1]).To(Equal(sentMessage{ID: page[1].ID, PhoneNumber: weekly.PhoneNumber, ScheduleID: 1, ReminderID: 2, Body: "reminder", ProviderID: "SM1", Status: messageSent, DueAt: 1, SentAt: 2}))
+
+			page, err = store.Messages(weekly.PhoneNumber, page[1].ID, 2)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(page).To(HaveLen(1))
+			Expect(page[0].DueAt).To(Equal(int64(0)))
+
+			everyone, err := store.Messages("", 0, 10)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(everyone).To(HaveLen(4))
+			Expect(everyone[0].Status).To(Equal(messageFailed))
+		})
+
+		It("should forget everything saved about a phone number", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			Expect(store.Save(monthly)).To(BeEmpty())
+			Expect(store.RemoveSchedule(weekly.PhoneNumber, 1, newRemoval(removedOnWeb, "req"))).To(BeTrue())
+			Expect(store.Save(weekly)).To(BeEmpty())
+			for _, phoneNumber := range []string{weekly.PhoneNumber, monthly.PhoneNumber} {
+				Expect(store.RecordMessage(sentMessage{PhoneNumber: phoneNumber, ScheduleID: 1, ReminderID: 1, Body: "reminder", Status: messageSent})).To(Succeed())
+				Expect(store.RecordLateReminder(lateReminder{ReminderID: 1, ScheduleID: 1, PhoneNumber: phoneNumber, DueAt: 1, HandledAt: 2, Outcome: outcomeSkipped})).To(Succeed())
+			}
+
+			Expect(store.RecordConsent(consentEvent{PhoneNumber: weekly.PhoneNumber, Kind: consentOptIn, Source: consentFromWeb, At: 1})).To(Succeed())
+
+			Expect(store.Forget(weekly.PhoneNumber)).To(Succeed())
+
+			Expect(store.Schedules(weekly.PhoneNumber)).To(BeEmpty())
+			Expect(store.RemovedSchedules(weekly.PhoneNumber)).To(BeEmpty())
+			Expect(store.ParkedSide(weekly.PhoneNumber)).To(Equal(""))
+			Expect(store.Messages(weekly.PhoneNumber, 0, 10)).To(BeEmpty())
+			stored, err := store.Reminders("", 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(stored).To(HaveLen(1))
+			Expect(stored[0].PhoneNumber).To(Equal(monthly.PhoneNumber))
+			late, err := store.LateReminders(time.Unix(0, 0), time.Unix(10, 0))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(late).To(HaveLen(1))
+			Expect(late[0].PhoneNumber).To(Equal(monthly.PhoneNumber))
+
+			Expect(store.Schedules(monthly.PhoneNumber)).To(HaveLen(1))
+			Expect(store.Messages(monthly.PhoneNumber, 0, 10)).To(HaveLen(1))
+
+			// the proof of when they opted in is kept
+			Expect(store.Consents(weekly.PhoneNumber)).To(HaveLen(1))
+		})
+
+		It("should keep each phone number's consent ledger, oldest first", func() {
+			events := []consentEvent{
+				{PhoneNumber: weekly.PhoneNumber, Kind: consentOptIn, Source: consentFromWeb, DisclosureVersion: disclosureVersion, IPHash: consentHash("10.0.0.1"), UserAgentHash: consentHash("curl"), RequestID: "req1", At: 100},
+				{PhoneNumber: monthly.PhoneNumber, Kind: consentOptIn, Source: consentFromWeb, DisclosureVersion: disclosureVersion, RequestID: "req2", At: 150},
+				{PhoneNumber: weekly.PhoneNumber, Kind: consentOptOut, Source: consentFromSMS, DisclosureVersion: disclosureVersion, RequestID: "SM1", At: 200},
+			}
+			for _, c := range events {
+				Expect(store.RecordConsent(c)).To(Succeed())
+			}
+
+			consents, err := store.Consents(weekly.PhoneNumber)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(consents).To(HaveLen(2))
+			for i, c := range []consentEvent{events[0], events[2]} {
+				c.ID = consents[i].ID
+				Expect(consents[i]).To(Equal(c))
+			}
+			Expect(store.Consents("0000000000")).To(BeEmpty())
+		})
+
+		It("should purge the delivery log sent before a time", func() {
+			for _, sentAt := range []int64{100, 200, 300} {
+				Expect(store.RecordMessage(sentMessage{PhoneNumber: weekly.PhoneNumber, ScheduleID: 1, ReminderID: 1, Body: "reminder", Status: messageSent, SentAt: sentAt})).To(Succeed())
+			}
+
+			Expect(store.PurgeMessages(250)).To(Equal(2))
+
+			left, err := store.Messages("", 0, 10)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(left).To(HaveLen(1))
+			Expect(left[0].SentAt).To(Equal(int64(300)))
+		})
+
+		It("should find the subscribers whose last texts were all undeliverable", func() {
+			Expect(store.Save(weekly)).To(BeEmpty())
+			Expect(store.Save(monthly)).To(BeEmpty())
+			record := func(phoneNumber string, status string) {
+				schedules, err := store.Schedules(phoneNumber)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(store.RecordMessage(sentMessage{PhoneNumber: phoneNumber, ScheduleID: schedules[0].ID, ReminderID: 1, Body: "reminder", Status: status})).To(Succeed())
+			}
+			record(weekly.PhoneNumber, messageSent)
+			record(weekly.PhoneNumber, messageUndeliverable)
+			record(weekly.PhoneNumber, messageUndeliverable)
+			record(monthly.PhoneNumber, messageUndeliverable)
+			record(monthly.PhoneNumber, messageFailed)
+
+			Expect(store.UndeliverableSubscribers(2)).To(Equal([]string{weekly.PhoneNumber}))
+			Expect(store.UndeliverableSubscribers(3)).To(BeEmpty())
+
+			// texts for removed schedules don't count, so signing up again starts over
+			Expect(store.Remove(weekly.PhoneNumber, newRemoval(removedUndeliverable, "job"))).To(Succeed())
+			Expect(store.Save(weekly)).To(BeEmpty())
+			Expect(store.UndeliverableSubscribers(2)).To(BeEmpty())
+		})
+
+		It("should list late reminders due in a window, oldest first", func() {
+			since := time.Unix(1500000000, 0)
+			late := []lateReminder{
+				{ReminderID: 1, ScheduleID: 1, PhoneNumber: "1234567890", DueAt: since.Unix() + 60, HandledAt: since.Unix() + 3600, Outcome: outcomeSentLate},
+				{ReminderID: 2, ScheduleID: 1, PhoneNumber: "1234567890", DueAt: since.Unix() - 60, HandledAt: since.Unix() + 3600, Outcome: outcomeSkipped},
+				{ReminderID: 3, ScheduleID: 2, PhoneNumber: "5555555555", DueAt: since.Unix() + 30, HandledAt: since.Unix() + 3600, Outcome: outcomeApologized},
+			}
+			for _, l := range late {
+				Expect(store.RecordLateReminder(l)).To(Succeed())
+			}
+
+			found, err := store.LateReminders(since, since.Add(time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(Equal([]lateReminder{late[2], late[0]}))
+		})
+	})
+}
+
+var _ = Describe("retention", func() {
+	It("should purge old messages and removed schedules, and remove undeliverable subscribers", func() {
+		store := NewMemoryStore()
+		env := &Env{Store: store}
+		now := Now().Unix()
+		day := int64(24 * 60 * 60)
+
+		reachable := alert{Timezone: "America/New_York", Times: []Day{{NthWeek: 1, Weekday: 0}}, PhoneNumber: "5555555555"}
+		unreachable := alert{Timezone: "America/New_York", Times: []Day{{NthWeek: 2, Weekday: 0}}, PhoneNumber: "1234567890"}
+		gone := alert{Timezone: "America/New_York", Times: []Day{{NthWeek: 3, Weekday: 0}}, PhoneNumber: "4444444444"}
+		for _, a := range []alert{reachable, unreachable, gone} {
+			Expect(store.Save(a)).To(BeEmpty())
+		}
+		Expect(store.Remove(gone.PhoneNumber, removal{At: now - 100*day, Reason: removedOnWeb})).To(Succeed())
+		Expect(store.RecordMessage(sentMessage{PhoneNumber: reachable.PhoneNumber, ScheduleID: 1, Status: messageSent, SentAt: now - 400*day})).To(Succeed())
+		Expect(store.RecordMessage(sentMessage{PhoneNumber: reachable.PhoneNumber, ScheduleID: 1, Status: messageSent, SentAt: now - day})).To(Succeed())
+		schedules, err := store.Schedules(unreachable.PhoneNumber)
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < 3; i++ {
+			Expect(store.RecordMessage(sentMessage{PhoneNumber: unreachable.PhoneNumber, ScheduleID: schedules[0].ID, Status: messageUndeliverable, SentAt: now})).To(Succeed())
+		}
+
+		summary, err := env.applyRetention(defaultRetentionPolicy)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summary).To(Equal(retentionSummary{MessagesPurged: 1, SubscribersRemoved: 1, RemovedSchedulesPurged: 1}))
+
+		Expect(store.Schedules(reachable.PhoneNumber)).To(HaveLen(1))
+		Expect(store.Schedules(unreachable.PhoneNumber)).To(BeEmpty())
+		removed, err := store.RemovedSchedules(unreachable.PhoneNumber)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(removed).To(HaveLen(1))
+		Expect(removed[0].Removed.Reason).To(Equal(removedUndeliverable))
+		Expect(store.RemovedSchedules(gone.PhoneNumber)).To(BeEmpty())
+	})
+
+	It("should turn off the parts of the policy that are 0", func() {
+		store := NewMemoryStore()
+		env := &Env{Store: store}
+		Expect(store.RecordMessage(sentMessage{PhoneNumber: "5555555555", ScheduleID: 1, Status: messageSent, SentAt: 1})).To(Succeed())
+
+		summary, err := env.applyRetention(retentionPolicy{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summary).To(Equal(retentionSummary{}))
+		Expect(store.Messages("", 0, 10)).To(HaveLen(1))
+	})
+})
+
+var _ = Describe("recompute", func() {
+	var env *Env
+	var want map[int]int64
+	var laSchedule int
+
+	// nextCalls returns the next call of each saved reminder, by ID
+	nextCalls := func() map[int]int64 {
+		stored, err := env.Store.Reminders("", 0)
+		Expect(err).NotTo(HaveOccurred())
+		calls := map[int]int64{}
+		for _, r := range stored {
+			calls[r.ID] = r.NextCall
+		}
+		return calls
+	}
+
+	// run runs the recompute command with args, and returns what it printed
+	run := func(args ...string) string {
+		var out bytes.Buffer
+		Expect(env.recomputeNextCalls(&out, args)).To(Succeed())
+		return out.String()
+	}
+
+	// every reminder starts out an hour off, like after a timezone database change
+	BeforeEach(func() {
+		env = &Env{Store: NewMemoryStore()}
+		alerts := []alert{
+			{Timezone: "America/Los_Angeles", Times: []Day{{Kind: kindWeekly, Weekday: 2}}, Reminders: []Reminder{{DaysBefore: 1, Time: "19:00"}, {DaysBefore: 0, Time: "07:00"}}, PhoneNumber: "1234567890"},
+			{Timezone: "America/New_York", Times: []Day{{NthWeek: 1, Weekday: 0}}, PhoneNumber: "5555555555"},
+		}
+		for _, a := range alerts {
+			Expect(env.Store.Save(a)).To(BeEmpty())
+		}
+		stored, err := env.Store.Reminders("", 0)
+		Expect(err).NotTo(HaveOccurred())
+		want = map[int]int64{}
+		var changes []nextCallChange
+		for _, r := range stored {
+			want[r.ID] = r.NextCall
+			changes = append(changes, nextCallChange{ReminderID: r.ID, ScheduleID: r.ScheduleID, Old: r.NextCall, New: r.NextCall + 3600})
+			if r.Timezone == "America/Los_Angeles" {
+				laSchedule = r.ScheduleID
+			}
+		}
+		Expect(env.Store.UpdateNextCalls(changes)).To(BeEmpty())
+	})
+
+	It("should fix every next call, or only list the fixes with -dry-run", func() {
+		before := nextCalls()
+		out := run("-dry-run")
+		Expect(out).To(ContainSubstring("3 of 3 reminders changed"))
+		Expect(out).NotTo(ContainSubstring("saved"))
+		Expect(nextCalls()).To(Equal(before))
+
+		out = run()
+		Expect(out).To(ContainSubstring("3 of 3 reminders changed"))
+		Expect(out).To(ContainSubstring("saved"))
+		Expect(nextCalls()).To(Equal(want))
+
+		Expect(run()).To(ContainSubstring("0 of 3 reminders changed"))
+	})
+
+	It("should only fix the schedules in -timezone, or the one with -id", func() {
+		Expect(run("-timezone", "America/New_York")).To(ContainSubstring("1 of 1 reminders changed"))
+		newYork, err := env.Store.Reminders("America/New_York", 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(newYork[0].NextCall).To(Equal(want[newYork[0].ID]))
+		losAngeles, err := env.Store.Reminders("", laSchedule)
+		Expect(err).NotTo(HaveOccurred())
+		for _, r := range losAngeles {
+			Expect(r.NextCall).To(Equal(want[r.ID] + 3600))
+		}
+
+		out := run("-id", strconv.Itoa(laSchedule))
+		Expect(out).To(ContainSubstring("2 of 2 reminders changed"))
+		Expect(nextCalls()).To(Equal(want))
+	})
+
+	It("should save the changes in batches", func() {
+		Expect(run("-batch", "1")).To(ContainSubstring("saved"))
+		Expect(nextCalls()).To(Equal(want))
+
+		var out bytes.Buffer
+		Expect(env.recomputeNextCalls(&out, []string{"-batch", "0"})).NotTo(Succeed())
+	})
+
+	It("should leave reminders that are already due for FindReadyAlerts", func() {
+		stored, err := env.Store.Reminders("", 0)
+		Expect(err).NotTo(HaveOccurred())
+		due := stored[0]
+		Expect(env.Store.UpdateNextCalls([]nextCallChange{{ReminderID: due.ID, ScheduleID: due.ScheduleID, Old: due.NextCall, New: Now().Unix() - 60}})).To(BeEmpty())
+
+		Expect(run()).To(ContainSubstring("2 of 3 reminders changed"))
+		Expect(nextCalls()[due.ID]).To(Equal(Now().Unix() - 60))
+	})
+
+	It("should park reminders that can't be scheduled any more", func() {
+		oldNow := Now
+		defer func() { Now = oldNow }()
+		Now = func() time.Time { return time.Date(2017, 4, 6, 0, 0, 0, 0, time.UTC) }
+
+		env.Store = NewMemoryStore()
+		rruleAlert := alert{Timezone: "America/New_York", Times: []Day{{Kind: kindRRule, RRule: "FREQ=WEEKLY;BYDAY=TU;UNTIL=20170601"}}, PhoneNumber: "1234567890"}
+		Expect(env.Store.Save(rruleAlert)).To(BeEmpty())
+		stored, err := env.Store.Reminders("", 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stored).To(HaveLen(1))
+		// a next call a bug put after the rule ran out
+		Expect(env.Store.UpdateNextCalls([]nextCallChange{{ReminderID: stored[0].ID, ScheduleID: stored[0].ScheduleID, Old: stored[0].NextCall, New: 2000000000}})).To(BeEmpty())
+
+		Now = func() time.Time { return time.Date(2017, 7, 1, 0, 0, 0, 0, time.UTC) }
+		Expect(run()).To(ContainSubstring("never"))
+		Expect(nextCalls()[stored[0].ID]).To(Equal(int64(math.MaxInt64)))
+	})
+})
+
+var _ = Describe("opting out", func() {
+	It("should go by when consent events happened, not the order they were recorded in", func() {
+		env := &Env{Store: NewMemoryStore()}
+		record := func(kind string, at int64) {
+			Expect(env.Store.RecordConsent(consentEvent{PhoneNumber: "1234567890", Kind: kind, Source: consentFromWeb, DisclosureVersion: disclosureVersion, At: at})).To(Succeed())
+		}
+		optedOut := func() bool {
+			out, err := env.optedOut("1234567890")
+			Expect(err).NotTo(HaveOccurred())
+			return out
+		}
+
+		Expect(optedOut()).To(BeFalse())
+		record(consentOptOut, 1500000200)
+		// an older opt in, like from a snapshot, doesn't undo it
+		record(consentOptIn, 1500000100)
+		Expect(optedOut()).To(BeTrue())
+		record(consentOptIn, 1500000300)
+		Expect(optedOut()).To(BeFalse())
+		// at the same time, the one recorded last wins
+		record(consentOptOut, 1500000300)
+		Expect(optedOut()).To(BeTrue())
+	})
+})
+
+var _ = Describe("late report", func() {
+	var env *Env
+
+	BeforeEach(func() {
+		env = &Env{Store: NewMemoryStore()}
+		late := []lateReminder{
+			{ReminderID: 1, ScheduleID: 2, PhoneNumber: "1234567890", DueAt: 1504551600, HandledAt: 1504555200, Outcome: outcomeSentLate},
+			{ReminderID: 3, ScheduleID: 4, PhoneNumber: "5555555555", DueAt: 1504638000, HandledAt: 1504670400, Outcome: outcomeApologized},
+		}
+		for _, l := range late {
+			Expect(env.Store.RecordLateReminder(l)).To(Succeed())
+		}
+	})
+
+	It("should list the late reminders due between -since and -until", func() {
+		var out bytes.Buffer
+		Expect(env.lateReport(&out, []string{"-since", "2017-09-04T00:00:00Z", "-until", "2017-09-05T00:00:00Z"})).To(Succeed())
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		Expect(lines).To(HaveLen(3))
+		Expect(strings.Fields(lines[1])).To(Equal([]string{"2", "1", "1234567890", "2017-09-04T19:00:00Z", "2017-09-04T20:00:00Z", "sent_late"}))
+		Expect(lines[2]).To(Equal("1 late or skipped reminders"))
+
+		out.Reset()
+		Expect(env.lateReport(&out, []string{"-since", "2017-09-04T00:00:00Z", "-until", "2017-09-06T00:00:00Z"})).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("apologized"))
+		Expect(out.String()).To(ContainSubstring("2 late or skipped reminders"))
+	})
+
+	It("should need -since, and times it can read", func() {
+		var out bytes.Buffer
+		Expect(env.lateReport(&out, nil)).NotTo(Succeed())
+		Expect(env.lateReport(&out, []string{"-since", "yesterday"})).NotTo(Succeed())
+		Expect(env.lateReport(&out, []string{"-since", "2017-09-04T00:00:00Z", "-until", "tomorrow"})).NotTo(Succeed())
+		Expect(out.String()).To(BeEmpty())
+	})
+})
+
+// countingSender is a message service that only counts the texts it sends.
+type countingSender struct {
+	MessageServicer
+	sent int
+}
+
+func (c *countingSender) Send(from, to, body string) (string, error) {
+	c.sent++
+	return "SM" + to, nil
+}
+
+var _ = Describe("snapshots", func() {
+	var from *Env
+	var oldNow func() time.Time
+
+	// at moves Now to t, in New York
+	at := func(year int, month time.Month, day, hour int) {
+		location, err := time.LoadLocation("America/New_York")
+		Expect(err).NotTo(HaveOccurred())
+		t := time.Date(year, month, day, hour, 0, 0, 0, location)
+		Now = func() time.Time { return t }
+	}
+
+	BeforeEach(func() {
+		oldNow = Now
+		at(2017, 4, 6, 0)
+	})
+
+	AfterEach(func() {
+		Now = oldNow
+	})
+
+	BeforeEach(func() {
+		from = &Env{Store: NewMemoryStore()}
+		alerts := []alert{
+			{
+				Timezone:    "America/Los_Angeles",
+				Times:       []Day{{Kind: kindWeekly, Weekday: 2, Start: "08:00", End: "10:00", Side: sideOdd, Season: &Season{Start: "04-01", End: "11-30"}}},
+				Reminders:   []Reminder{{DaysBefore: 1, Time: "19:00"}, {DaysBefore: 0, Time: "07:00"}},
+				ParkedSide:  sideOdd,
+				PhoneNumber: "1234567890",
+			},
+			{Timezone: "America/New_York", Times: []Day{{NthWeek: 1, Weekday: 0}, {NthWeek: 3, Weekday: 4}}, PhoneNumber: "5555555555"},
+		}
+		for _, a := range alerts {
+			Expect(from.Store.Save(a)).To(BeEmpty())
+		}
+		consents := []consentEvent{
+			{PhoneNumber: "1234567890", Kind: consentOptIn, Source: consentFromWeb, DisclosureVersion: disclosureVersion, IPHash: "ip", UserAgentHash: "ua", RequestID: "req-1", At: 1500000000},
+			{PhoneNumber: "5555555555", Kind: consentOptIn, Source: consentFromWeb, DisclosureVersion: disclosureVersion, RequestID: "req-2", At: 1500000100},
+			// someone who opted out, and has nothing else saved, but whose ledger still has to be kept
+			{PhoneNumber: "9999999999", Kind: consentOptOut, Source: consentFromSMS, DisclosureVersion: disclosureVersion, RequestID: "SM1", At: 1500000200},
+		}
+		for _, c := range consents {
+			Expect(from.Store.RecordConsent(c)).To(Succeed())
+		}
+		// a next call the import couldn't work out for itself
+		stored, err := from.Store.Reminders("", 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(from.Store.UpdateNextCalls([]nextCallChange{{ReminderID: stored[0].ID, ScheduleID: stored[0].ScheduleID, Old: stored[0].NextCall, New: stored[0].NextCall + 7*24*60*60}})).To(BeEmpty())
+	})
+
+	It("should import the same subscribers and schedules it exported, from JSON or CSV, any number of times", func() {
+		snap, err := from.takeSnapshot()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(snap.Subscribers).To(HaveLen(2))
+		Expect(snap.Consents).To(HaveLen(3))
+
+		var buf bytes.Buffer
+		Expect(writeSnapshotCSV(&buf, snap)).To(Succeed())
+		fromCSV, err := readSnapshotCSV(&buf)
+		Expect(err).NotTo(HaveOccurred())
+		fromCSV.ExportedAt = snap.ExportedAt
+		Expect(fromCSV).To(Equal(snap))
+
+		to := &Env{Store: NewMemoryStore()}
+		summary, err := to.restoreSnapshot(snap)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summary).To(Equal(importSummary{Subscribers: 2, Schedules: 3, Consents: 3}))
+		summary, err = to.restoreSnapshot(fromCSV)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summary).To(Equal(importSummary{Subscribers: 2, Schedules: 3, AlreadySaved: 3, Consents: 3, AlreadyRecorded: 3}))
+
+		imported, err := to.takeSnapshot()
+		Expect(err).NotTo(HaveOccurred())
+		imported.ExportedAt = snap.ExportedAt
+		Expect(imported).To(Equal(snap))
+	})
+
+	It("should refuse snapshots with a schedule or consent it couldn't save, before saving anything", func() {
+		snap, err := from.takeSnapshot()
+		Expect(err).NotTo(HaveOccurred())
+		snap.Subscribers[1].Schedules[1].Timezone = "America/Nowhere"
+
+		to := &Env{Store: NewMemoryStore()}
+		_, err = to.restoreSnapshot(snap)
+		Expect(err).To(MatchError(ContainSubstring("subscriber 2, schedule 2")))
+		stored, err := to.Store.Reminders("", 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stored).To(BeEmpty())
+
+		var buf bytes.Buffer
+		Expect(writeSnapshotCSV(&buf, snap)).To(Succeed())
+		_, err = readSnapshotCSV(&buf)
+		Expect(err).To(MatchError(ContainSubstring("line 6")))
+
+		snap, err = from.takeSnapshot()
+		Expect(err).NotTo(HaveOccurred())
+		snap.Consents[2].Kind = "maybe"
+		_, err = to.restoreSnapshot(snap)
+		Expect(err).To(MatchError(ContainSubstring("consent 3")))
+		consents, err := to.Store.Consents("")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(consents).To(BeEmpty())
+
+		buf.Reset()
+		Expect(writeSnapshotCSV(&buf, snap)).To(Succeed())
+		_, err = readSnapshotCSV(&buf)
+		Expect(err).To(MatchError(ContainSubstring("line 11")))
+	})
+
+	It("should import version 1 snapshots, which have no consent ledger", func() {
+		to := &Env{Store: NewMemoryStore()}
+		csvSnapshot := "version,1\n" + strings.Join(snapshotColumns, ",") + "\n" +
+			"1234567890,,America/New_York,monthly,1,0,,,,,,,,1,19:00,1500000000\n"
+		snap, err := readSnapshotCSV(strings.NewReader(csvSnapshot))
+		Expect(err).NotTo(HaveOccurred())
+		summary, err := to.restoreSnapshot(snap)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summary).To(Equal(importSummary{Subscribers: 1, Schedules: 1}))
+	})
+
+	It("should not send reminders again when the same snapshot is imported after they went out", func() {
+		snap, err := from.takeSnapshot()
+		Expect(err).NotTo(HaveOccurred())
+		sender := &countingSender{}
+		to := &Env{MsgSvc: sender, Store: NewMemoryStore()}
+		_, err = to.restoreSnapshot(snap)
+		Expect(err).NotTo(HaveOccurred())
+
+		// the first sunday's reminder, 2017-05-06 19:00:00 -0400 EDT, goes out
+		at(2017, 5, 6, 20)
+		to.FindReadyAlerts()
+		Expect(sender.sent).To(Equal(1))
+
+		summary, err := to.restoreSnapshot(snap)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summary.AlreadySaved).To(Equal(3))
+		to.FindReadyAlerts()
+		Expect(sender.sent).To(Equal(1))
+	})
+
+	It("should move next calls that went by since the snapshot was taken on to the next sweeping day", func() {
+		snap, err := from.takeSnapshot()
+		Expect(err).NotTo(HaveOccurred())
+
+		// a month later, every reminder in the snapshot has gone by
+		at(2017, 5, 20, 12)
+		sender := &countingSender{}
+		to := &Env{MsgSvc: sender, Store: NewMemoryStore()}
+		_, err = to.restoreSnapshot(snap)
+		Expect(err).NotTo(HaveOccurred())
+
+		stored, err := to.Store.Reminders("", 0)
+		Expect(err).NotTo(HaveOccurred())
+		for _, r := range stored {
+			Expect(r.NextCall).To(BeNumerically(">", Now().Unix()))
+		}
+		to.FindReadyAlerts()
+		Expect(sender.sent).To(BeZero())
+	})
+
+	It("should skip the schedules of subscribers who opted out since the snapshot was taken", func() {
+		snap, err := from.takeSnapshot()
+		Expect(err).NotTo(HaveOccurred())
+		to := &Env{Store: NewMemoryStore()}
+		Expect(to.Store.RecordConsent(consentEvent{PhoneNumber: "5555555555", Kind: consentOptOut, Source: consentFromSMS, DisclosureVersion: disclosureVersion, At: 1500000500})).To(Succeed())
+
+		summary, err := to.restoreSnapshot(snap)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(summary.Subscribers).To(Equal(1))
+		Expect(summary.OptedOut).To(Equal(1))
+		schedules, err := to.Store.Schedules("5555555555")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(schedules).To(BeEmpty())
+		schedules, err = to.Store.Schedules("1234567890")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(schedules).To(HaveLen(1))
+	})
+
+	It("should refuse snapshots from a newer version", func() {
+		_, err := from.restoreSnapshot(snapshot{Version: snapshotVersion + 1})
+		Expect(err).To(HaveOccurred())
+	})
+})
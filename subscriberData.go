@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+)
+
+// subscriberDataRequest asks for a subscriber's data, or for it to be deleted. Like everything else someone does to
+// their alerts, it needs the code we texted them.
+type subscriberDataRequest struct {
+	PhoneNumber string `json:"phoneNumber"`
+	Token       string `json:"token"`
+}
+
+// subscriberData is everything we have saved about a subscriber, for when they ask what that is.
+type subscriberData struct {
+	PhoneNumber string           `json:"phoneNumber"`
+	ParkedSide  string           `json:"parkedSide"`
+	Schedules   []storedSchedule `json:"schedules"`
+	// Removed are the schedules they removed, with when and why, which we keep until they are purged.
+	Removed  []storedSchedule `json:"removed"`
+	Messages []sentMessage    `json:"messages"`
+	Consents []consentEvent   `json:"consents"`
+}
+
+// exportSubscriberData gathers everything saved about phoneNumber.
+func (env *Env) exportSubscriberData(phoneNumber string) (subscriberData, error) {
+	data := subscriberData{
+		PhoneNumber: phoneNumber,
+		Schedules:   []storedSchedule{},
+		Removed:     []storedSchedule{},
+		Messages:    []sentMessage{},
+		Consents:    []consentEvent{},
+	}
+	var err error
+	data.ParkedSide, err = env.Store.ParkedSide(phoneNumber)
+	if err != nil {
+		return data, err
+	}
+	schedules, err := env.Store.Schedules(phoneNumber)
+	if err != nil {
+		return data, err
+	}
+	data.Schedules = append(data.Schedules, schedules...)
+	removed, err := env.Store.RemovedSchedules(phoneNumber)
+	if err != nil {
+		return data, err
+	}
+	data.Removed = append(data.Removed, removed...)
+	consents, err := env.Store.Consents(phoneNumber)
+	if err != nil {
+		return data, err
+	}
+	data.Consents = append(data.Consents, consents...)
+
+	before := 0
+	for {
+		page, err := env.Store.Messages(phoneNumber, before, maxHistoryLimit)
+		if err != nil {
+			return data, err
+		}
+		data.Messages = append(data.Messages, page...)
+		if len(page) < maxHistoryLimit {
+			return data, nil
+		}
+		before = page[len(page)-1].ID
+	}
+}
+
+// verifiedSubscriber decodes a subscriberDataRequest and checks its code. It writes the error response and returns
+// false if it can't.
+func (env *Env) verifiedSubscriber(w http.ResponseWriter, r *http.Request) (string, bool) {
+	decoder := json.NewDecoder(r.Body)
+	var t subscriberDataRequest
+	err := decoder.Decode(&t)
+	if err != nil {
+		log.Println("error decoding json: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "oops! we made a mistake")
+		return "", false
+	}
+	defer r.Body.Close()
+
+	verified, err := env.MsgSvc.VerifyCode(t.PhoneNumber, t.Token)
+	if err != nil || !verified {
+		log.Println("error verifying code: error: ", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, "validation code incorrect")
+		return "", false
+	}
+	return t.PhoneNumber, true
+}
+
+// subscriberExportHandler gives someone everything we have saved about them, once they have verified their phone
+// number.
+func (env *Env) subscriberExportHandler(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, ok := env.verifiedSubscriber(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := env.exportSubscriberData(phoneNumber)
+	if err != nil {
+		log.Println("problem exporting subscriber data: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "oops! we made a mistake")
+		return
+	}
+	log.Println("exported a subscriber's data in request ", requestID(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+// subscriberDeleteHandler deletes everything we have saved about someone, once they have verified their phone
+// number. Unlike stopping their alerts, this can't be undone.
+func (env *Env) subscriberDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	phoneNumber, ok := env.verifiedSubscriber(w, r)
+	if !ok {
+		return
+	}
+
+	err := env.Store.Forget(phoneNumber)
+	if err != nil {
+		log.Println("problem deleting subscriber data: ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "oops! we made a mistake")
+		return
+	}
+	env.recordOptOut(webConsent(r, phoneNumber, consentOptOut))
+	// the phone number isn't logged, since the point is that we don't keep it
+	log.Println("deleted a subscriber's data in request ", requestID(r))
+	w.WriteHeader(http.StatusOK)
+}
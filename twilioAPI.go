@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net/http"
 	"net/url"
 
 	"fmt"
@@ -12,6 +13,7 @@ import (
 type MessageServicer interface {
 	phoneVerifier
 	smsMessager
+	requestChecker
 }
 
 type phoneVerifier interface {
@@ -19,18 +21,51 @@ type phoneVerifier interface {
 	VerifyCode(phoneNumber, code string) (bool, error)
 }
 
+// smsMessager sends texts. Send returns the message service's ID for the text it sent.
 type smsMessager interface {
-	Send(from, to, body string) error
+	Send(from, to, body string) (string, error)
+}
+
+// requestChecker checks that a webhook request really came from the message service.
+type requestChecker interface {
+	CheckRequest(r *http.Request) (bool, error)
 }
 
 type twilioMessageService struct {
 	authy  *authy.Authy
 	twilio *gotwilio.Twilio
+
+	// baseURL is the scheme and host twilio uses to reach us, like https://dontfearthesweeper.herokuapp.com. It is
+	// part of what twilio signs in its webhook requests.
+	baseURL string
+}
+
+func (t *twilioMessageService) Send(from, to, body string) (string, error) {
+	response, exception, err := t.twilio.SendSMS("+1"+from, "+1"+to, body, "", "")
+	if err != nil {
+		return "", err
+	}
+	if exception != nil {
+		if undeliverableCodes[exception.Code] {
+			return "", undeliverableError{fmt.Sprintf("twilio error %d: %s", exception.Code, exception.Message)}
+		}
+		return "", fmt.Errorf("twilio error %d: %s", exception.Code, exception.Message)
+	}
+	return response.Sid, nil
 }
 
-func (t *twilioMessageService) Send(from, to, body string) error {
-	_, _, err := t.twilio.SendSMS("+1"+from, "+1"+to, body, "", "") // todo: should not ignore those returns
-	return err
+// undeliverableCodes are the twilio errors that mean texts will never reach a phone number: it isn't valid, can't
+// be reached, has texted STOP to us, can't be routed to, or isn't a mobile number.
+var undeliverableCodes = map[int]bool{21211: true, 21214: true, 21610: true, 21612: true, 21614: true}
+
+// undeliverableError is the error Send returns when a text will never reach the phone number it was sent to, so
+// there is no point trying again.
+type undeliverableError struct {
+	message string
+}
+
+func (e undeliverableError) Error() string {
+	return e.message
 }
 
 func (t *twilioMessageService) RequestCode(phoneNumber string) (bool, error) {
@@ -39,6 +74,10 @@ func (t *twilioMessageService) RequestCode(phoneNumber string) (bool, error) {
 	return verification.Success, err
 }
 
+func (t *twilioMessageService) CheckRequest(r *http.Request) (bool, error) {
+	return t.twilio.CheckRequestSignature(r, t.baseURL)
+}
+
 func (t *twilioMessageService) VerifyCode(phoneNumber, code string) (bool, error) {
 	verification, err := t.authy.CheckPhoneVerification(1, phoneNumber, code, url.Values{})
 	return verification.Success, err